@@ -4,17 +4,46 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"os/user"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kei2100/go-graceful"
+	"github.com/kei2100/go-graceful/worker"
 	"github.com/spf13/pflag"
 )
 
 var (
 	listens            []string
 	env                []string
+	systemd            bool
+	listenFDsEnv       bool
+	envDialects        []string
+	tlsCertFile        string
+	tlsKeyFile         string
+	reusePort          bool
+	handoff            bool
+	backlog            int
+	keepAlive          time.Duration
+	deferAccept        time.Duration
+	fastOpen           int
+	v6Only             bool
+	freeBind           bool
+	bindToDevice       string
+	userName           string
+	groupName          string
+	takeoverSocket     string
+	proxyNetwork       string
+	subreaper          bool
+	initMode           bool
 	autoRestartEnabled bool
+	restartBackoff     time.Duration
+	restartMaxBackoff  time.Duration
+	restartMax         int
+	restartWindow      time.Duration
 	startTimeout       time.Duration
 	shutdownTimeout    time.Duration
 	restartTimeout     time.Duration
@@ -33,12 +62,41 @@ func init() {
 		fmt.Fprintf(os.Stderr, "The %s provides graceful terminate and restart for socket-based servers\n\n", name)
 		fmt.Fprintf(os.Stderr, "Usage:\n")
 		fmt.Fprintf(os.Stderr, "  %s [flags] -- <command> [args...]\n\n", name)
+		fmt.Fprintf(os.Stderr, "Signals:\n")
+		fmt.Fprintf(os.Stderr, "  HUP   graceful restart the worker\n")
+		fmt.Fprintf(os.Stderr, "  USR2  re-exec the %s binary itself without stopping the worker\n", name)
+		fmt.Fprintf(os.Stderr, "  the other catchable signals are forwarded to the worker in the --init mode,\n")
+		fmt.Fprintf(os.Stderr, "  except CHLD, URG, PROF, PIPE and the faults, e.g. SEGV\n\n")
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		pflag.PrintDefaults()
 	}
-	pflag.StringSliceVarP(&listens, "listen", "l", []string{}, "listen tcp address(es). e.g. -l 127.0.0.1:8000 -l 127.0.0.1:8001")
+	pflag.StringSliceVarP(&listens, "listen", "l", []string{}, "listen tcp address(es) or unix domain socket path(s), optionally named. e.g. -l 127.0.0.1:8000 -l unix:/tmp/app.sock -l udp:127.0.0.1:5353 -l unixgram:/tmp/log.sock -l admin=127.0.0.1:9000. the socket options of each listener can follow the last '?', e.g. -l '127.0.0.1:8000?backlog=1024&defer-accept=5s'. the path including '?' must end with '?', e.g. -l 'unix:/tmp/a?b.sock?'")
+	pflag.BoolVar(&systemd, "systemd", false, "adopt the sockets passed by systemd socket activation (LISTEN_FDS) in addition to the --listen")
+	pflag.BoolVar(&listenFDsEnv, "listen-fds-env", false, "set LISTEN_FDS, LISTEN_FDNAMES and LISTEN_PID to the worker so that the worker can use the sockets as systemd socket activation")
+	pflag.StringSliceVar(&envDialects, "env-dialect", []string{}, "also set the environment variables of the other supervisors to the worker. server-starter, einhorn or tableflip. e.g. --env-dialect server-starter. tableflip moves the listeners to the fds from 5")
+	pflag.StringVar(&tlsCertFile, "tls-cert", "", "certificate file passed to the worker for InheritOrListenTLS")
+	pflag.StringVar(&tlsKeyFile, "tls-key", "", "key file passed to the worker for InheritOrListenTLS")
+	pflag.BoolVar(&reusePort, "reuseport", false, "each worker binds the --listen address(es) by itself with SO_REUSEPORT, instead of inheriting the sockets of the graceful. tcp and udp only")
+	pflag.BoolVar(&handoff, "handoff", false, "enable the handoff sockets between the old and the new worker on restart, for the state and the idle connections")
+	pflag.IntVar(&backlog, "backlog", 0, "maximum length of the accept queue of the listeners. 0 uses the system default")
+	pflag.DurationVar(&keepAlive, "keepalive", 0, "TCP keep-alive period of the connections accepted from the listeners. negative disables the keep-alive")
+	pflag.DurationVar(&deferAccept, "defer-accept", 0, "set TCP_DEFER_ACCEPT to the tcp listeners, the connection is not accepted until the data arrives or the timeout (linux only)")
+	pflag.IntVar(&fastOpen, "fastopen", 0, "set TCP_FASTOPEN to the tcp listeners with the length of the queue (linux only)")
+	pflag.BoolVar(&v6Only, "v6only", false, "set IPV6_V6ONLY so that the sockets bound to IPv6 addresses do not handle IPv4")
+	pflag.BoolVar(&freeBind, "freebind", false, "set IP_FREEBIND to bind the addresses that are not assigned to the host yet (linux only)")
+	pflag.StringVar(&bindToDevice, "bind-to-device", "", "set SO_BINDTODEVICE to handle the packets only from the device (linux only)")
+	pflag.StringVar(&userName, "user", "", "run the worker as the user, name or uid. the graceful binds the listeners before that. e.g. --user www-data")
+	pflag.StringVar(&groupName, "group", "", "run the worker as the group, name or gid. defaults to the primary group of the --user")
+	pflag.StringVar(&takeoverSocket, "takeover", "", "unix domain socket path to take over the listeners from the running graceful. the running graceful is stopped after the worker is started, and this graceful serves the socket for the next one. e.g. --takeover /run/app-graceful.sock")
+	pflag.StringVar(&proxyNetwork, "proxy", "", "the graceful accepts on the --listen address(es) by itself and proxies to the private address(es) of each worker, tcp, unix or http. the worker binds GRACEFUL_PROXY_LISTENERS, or PORT if tcp or http, which is only the first --listen. http reverse proxies each request to the current worker. for the workers that can not inherit the sockets")
+	pflag.BoolVar(&subreaper, "subreaper", false, "adopt the orphaned descendants of the worker as the child subreaper, reap them and terminate them with the worker (linux only)")
+	pflag.BoolVar(&initMode, "init", false, "run as the init process (PID 1) of a container. reaps all the children and forwards the signals not handled by the graceful to the worker. enabled automatically when the graceful is PID 1")
 	pflag.StringSliceVarP(&env, "env", "e", []string{}, "additional environment variables. e.g. -e AAA=BBB -e CCC=DDD")
 	pflag.BoolVar(&autoRestartEnabled, "auto-restart-enabled", false, "specifies if the graceful should automatically restart a worker if the worker process exits")
+	pflag.DurationVar(&restartBackoff, "auto-restart-backoff", 100*time.Millisecond, "delay before the first auto restart, doubles on each successive restart")
+	pflag.DurationVar(&restartMaxBackoff, "auto-restart-max-backoff", 30*time.Second, "maximum delay of the auto restart")
+	pflag.IntVar(&restartMax, "auto-restart-max", 5, "the graceful exits as the crash loop if the worker is auto restarted more than this number of times within --auto-restart-window. 0 is unlimited")
+	pflag.DurationVar(&restartWindow, "auto-restart-window", time.Minute, "period to count the auto restarts for --auto-restart-max")
 	pflag.DurationVar(&startTimeout, "start-timeout", 10*time.Second, "amount of time the graceful will wait for the worker started")
 	pflag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "amount of time the graceful will wait for the worker shutdown")
 	pflag.DurationVar(&restartTimeout, "restart-timeout", 20*time.Second, "amount of time the graceful will wait for the worker restarted")
@@ -47,43 +105,431 @@ func init() {
 }
 
 func main() {
+	// the worker is started through this executable with --listen-fds-env
+	graceful.RunListenFDsTrampoline()
 	pflag.Parse()
 	args := pflag.Args()
 	if help || len(args) < 1 {
 		pflag.Usage()
 		os.Exit(2)
 	}
-	env = append(os.Environ(), env...)
-	lns, err := createListeners()
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatalln("main: both --tls-cert and --tls-key are required")
+	}
+	dialects, err := parseEnvDialects()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if os.Getpid() == 1 {
+		initMode = true
+	}
+	var forwardSignals []os.Signal
+	if initMode {
+		// as PID 1, the orphans in the container are reparented to the graceful
+		subreaper = true
+		forwardSignals = initForwardSignals()
+	}
+	cred, err := lookupCredential(userName, groupName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rpAddrs, namedRPAddrs := make([]net.Addr, 0), make(map[string]net.Addr)
+	if reusePort && proxyNetwork != "" {
+		log.Fatalln("main: --reuseport can not be used with --proxy")
+	}
+	if reusePort {
+		rpAddrs, namedRPAddrs, err = resolveReusePortAddrs()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		listens = nil
+	}
+	var lns []net.Listener
+	var namedLns map[string]net.Listener
+	var pcs []net.PacketConn
+	takeover, err := takeoverListeners()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	switch {
+	case graceful.IsUpgraded():
+		// the listeners are passed from the previous image of the graceful
+		lns, namedLns, pcs, err = graceful.UpgradedListeners()
+	case takeover != nil:
+		lns, namedLns, pcs = takeover.Listeners, takeover.NamedListeners, takeover.PacketConns
+	default:
+		lns, namedLns, pcs, err = createListeners()
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if takeover != nil {
+		// the running graceful keeps running if this graceful fails to start the worker
+		defer takeover.Close()
+	}
+	if systemd && !graceful.IsUpgraded() && takeover == nil {
+		if err := adoptSystemdSockets(&lns, namedLns, &pcs); err != nil {
+			closeListeners(lns)
+			closeNamedListeners(namedLns)
+			closePacketConns(pcs)
+			log.Fatalln(err)
+		}
+	}
+	// after adopting systemd sockets, LISTEN_* variables are removed from the environment
+	env = append(os.Environ(), env...)
 	defer closeListeners(lns)
+	defer closeNamedListeners(namedLns)
+	defer closePacketConns(pcs)
 
 	err = graceful.Serve(
 		args[0],
 		graceful.WithArgs(args[1:]...),
 		graceful.WithEnv(env...),
 		graceful.WithListeners(lns...),
+		graceful.WithNamedListeners(namedLns),
+		graceful.WithPacketConns(pcs...),
+		graceful.WithListenFDsEnvEnabled(listenFDsEnv),
+		graceful.WithEnvDialects(dialects...),
+		graceful.WithTLSFiles(tlsCertFile, tlsKeyFile),
+		graceful.WithReusePortAddrs(rpAddrs...),
+		graceful.WithNamedReusePortAddrs(namedRPAddrs),
+		graceful.WithHandoffEnabled(handoff),
+		graceful.WithCredential(cred),
+		graceful.WithUpgradeSignals(upgradeSignals()...),
+		graceful.WithTakeoverSocket(takeoverSocket),
+		graceful.WithTakeover(takeover),
+		graceful.WithProxy(proxyNetwork),
+		graceful.WithSubreaperEnabled(subreaper),
+		graceful.WithForwardSignals(forwardSignals...),
 		graceful.WithAutoRestartEnabled(autoRestartEnabled),
+		graceful.WithAutoRestartPolicy(worker.RestartPolicy{
+			InitialBackoff: restartBackoff,
+			MaxBackoff:     restartMaxBackoff,
+			MaxRestarts:    restartMax,
+			Window:         restartWindow,
+		}),
 		graceful.WithTimeout(startTimeout, restartTimeout, shutdownTimeout),
 		graceful.WithStopOldDelay(stopOldDelay),
 	)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		os.Exit(exitCode(err))
 	}
 }
 
-func createListeners() ([]net.Listener, error) {
+// exitCode returns the exit status of the graceful for the error of Serve.
+// the status of the worker is used if the worker is done by itself,
+// and 128+n if it is terminated by the signal n, as the shells do.
+func exitCode(err error) int {
+	if e, ok := err.(*worker.CrashLoopError); ok {
+		err = e.Err
+	}
+	e, ok := err.(*worker.ExitError)
+	if !ok {
+		return 1
+	}
+	if e.Signal != 0 {
+		return 128 + int(e.Signal)
+	}
+	if e.Code <= 0 {
+		return 1
+	}
+	return e.Code
+}
+
+func parseEnvDialects() ([]graceful.EnvDialect, error) {
+	dialects := make([]graceful.EnvDialect, 0)
+	for _, s := range envDialects {
+		d, err := graceful.ParseEnvDialect(s)
+		if err != nil {
+			return nil, fmt.Errorf("main: %v", err)
+		}
+		dialects = append(dialects, d)
+	}
+	return dialects, nil
+}
+
+func createListeners() ([]net.Listener, map[string]net.Listener, []net.PacketConn, error) {
 	lns := make([]net.Listener, 0)
-	for _, addr := range listens {
-		ln, err := net.Listen("tcp", addr)
+	namedLns := make(map[string]net.Listener)
+	pcs := make([]net.PacketConn, 0)
+	closeAll := func() {
+		closeListeners(lns)
+		closeNamedListeners(namedLns)
+		closePacketConns(pcs)
+	}
+	for _, l := range listens {
+		l, opts := splitListenOptions(l)
+		lc, err := listenConfig(opts)
 		if err != nil {
-			return nil, fmt.Errorf("main: failed to create a lister %s: %v", addr, err)
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("main: invalid options of %s: %v", l, err)
+		}
+		name, network, addr := parseListen(l)
+		if _, ok := namedLns[name]; ok {
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("main: duplicate listener name %s", name)
+		}
+		if network == "unix" || network == "unixgram" {
+			if err := removeStaleSocket(network, addr); err != nil {
+				closeAll()
+				return nil, nil, nil, err
+			}
+		}
+		switch network {
+		case "udp", "unixgram":
+			if name != "" {
+				closeAll()
+				return nil, nil, nil, fmt.Errorf("main: named packet conn is not supported %s", l)
+			}
+			pc, err := lc.ListenPacket(network, addr)
+			if err != nil {
+				closeAll()
+				return nil, nil, nil, fmt.Errorf("main: failed to create a packet conn %s: %v", l, err)
+			}
+			pcs = append(pcs, pc)
+		default:
+			ln, err := lc.Listen(network, addr)
+			if err != nil {
+				closeAll()
+				return nil, nil, nil, fmt.Errorf("main: failed to create a lister %s: %v", l, err)
+			}
+			if name != "" {
+				namedLns[name] = ln
+			} else {
+				lns = append(lns, ln)
+			}
 		}
-		lns = append(lns, ln)
 	}
-	return lns, nil
+	return lns, namedLns, pcs, nil
+}
+
+// resolveReusePortAddrs resolves the --listen addresses that each worker binds with SO_REUSEPORT
+func resolveReusePortAddrs() ([]net.Addr, map[string]net.Addr, error) {
+	addrs := make([]net.Addr, 0)
+	namedAddrs := make(map[string]net.Addr)
+	for _, l := range listens {
+		if _, opts := splitListenOptions(l); opts != "" {
+			return nil, nil, fmt.Errorf("main: the socket options of %s can not be used with --reuseport", l)
+		}
+		name, network, addr := parseListen(l)
+		var a net.Addr
+		var port int
+		switch network {
+		case "tcp":
+			tcpAddr, err := net.ResolveTCPAddr(network, addr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("main: failed to resolve %s: %v", l, err)
+			}
+			a, port = tcpAddr, tcpAddr.Port
+		case "udp":
+			udpAddr, err := net.ResolveUDPAddr(network, addr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("main: failed to resolve %s: %v", l, err)
+			}
+			a, port = udpAddr, udpAddr.Port
+		default:
+			return nil, nil, fmt.Errorf("main: %s can not be used with --reuseport", l)
+		}
+		if port == 0 {
+			return nil, nil, fmt.Errorf("main: the port of %s must be specified with --reuseport", l)
+		}
+		if name == "" {
+			addrs = append(addrs, a)
+			continue
+		}
+		if _, ok := namedAddrs[name]; ok {
+			return nil, nil, fmt.Errorf("main: duplicate listener name %s", name)
+		}
+		namedAddrs[name] = a
+	}
+	return addrs, namedAddrs, nil
+}
+
+// takeoverListeners takes over the listeners from the graceful running on the --takeover socket.
+// returns nil if no graceful is running.
+func takeoverListeners() (*graceful.Takeover, error) {
+	if takeoverSocket == "" || graceful.IsUpgraded() {
+		return nil, nil
+	}
+	t, err := graceful.TakeoverListeners(takeoverSocket)
+	if err == graceful.ErrNoRunningSupervisor {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("main: %v", err)
+	}
+	return t, nil
+}
+
+// lookupCredential resolves the credential of the worker from the user and the group.
+// returns nil if both are empty.
+func lookupCredential(userName, groupName string) (*worker.Credential, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	cred := &worker.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			// the id out of range may be truncated to the other user by the lookup
+			if u, err = user.LookupId(userName); err != nil || u.Uid != userName {
+				return nil, fmt.Errorf("main: unknown user %s", userName)
+			}
+		}
+		uid, err := parseID(u.Uid)
+		if err != nil {
+			return nil, fmt.Errorf("main: invalid uid of %s: %v", userName, err)
+		}
+		gid, err := parseID(u.Gid)
+		if err != nil {
+			return nil, fmt.Errorf("main: invalid gid of %s: %v", userName, err)
+		}
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("main: failed to lookup the groups of %s: %v", userName, err)
+		}
+		for _, g := range gids {
+			id, err := parseID(g)
+			if err != nil {
+				return nil, fmt.Errorf("main: invalid group id of %s: %v", userName, err)
+			}
+			cred.Groups = append(cred.Groups, id)
+		}
+		cred.Uid, cred.Gid = uid, gid
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil || g.Gid != groupName {
+				return nil, fmt.Errorf("main: unknown group %s", groupName)
+			}
+		}
+		gid, err := parseID(g.Gid)
+		if err != nil {
+			return nil, fmt.Errorf("main: invalid group %s: %v", groupName, err)
+		}
+		cred.Gid = gid
+	}
+	return cred, nil
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(n), nil
+}
+
+// splitListenOptions splits the listen flag value into the listen and the socket options at the last '?'.
+// the path including '?' must be followed by '?', even if it has no options.
+// e.g. 127.0.0.1:8000?backlog=1024 => 127.0.0.1:8000, backlog=1024
+// e.g. unix:/tmp/a?b.sock? => unix:/tmp/a?b.sock, ""
+func splitListenOptions(l string) (string, string) {
+	if i := strings.LastIndex(l, "?"); i >= 0 {
+		return l[:i], l[i+1:]
+	}
+	return l, ""
+}
+
+// listenConfig creates the socket options from the flags, overridden by the options of the listener
+func listenConfig(opts string) (graceful.ListenConfig, error) {
+	lc := graceful.ListenConfig{
+		Backlog:      backlog,
+		KeepAlive:    keepAlive,
+		DeferAccept:  deferAccept,
+		FastOpen:     fastOpen,
+		V6Only:       v6Only,
+		FreeBind:     freeBind,
+		BindToDevice: bindToDevice,
+	}
+	q, err := url.ParseQuery(opts)
+	if err != nil {
+		return lc, err
+	}
+	for k := range q {
+		v := q.Get(k)
+		switch k {
+		case "backlog":
+			lc.Backlog, err = strconv.Atoi(v)
+		case "keepalive":
+			lc.KeepAlive, err = time.ParseDuration(v)
+		case "defer-accept":
+			lc.DeferAccept, err = time.ParseDuration(v)
+		case "fastopen":
+			lc.FastOpen, err = strconv.Atoi(v)
+		case "v6only":
+			lc.V6Only, err = strconv.ParseBool(v)
+		case "freebind":
+			lc.FreeBind, err = strconv.ParseBool(v)
+		case "bind-to-device":
+			lc.BindToDevice = v
+		default:
+			err = fmt.Errorf("unknown option %s", k)
+		}
+		if err != nil {
+			return lc, err
+		}
+	}
+	return lc, nil
+}
+
+// adoptSystemdSockets appends the sockets passed by systemd socket activation
+func adoptSystemdSockets(lns *[]net.Listener, namedLns map[string]net.Listener, pcs *[]net.PacketConn) error {
+	socks, err := graceful.SystemdActivatedSockets()
+	if err != nil {
+		return fmt.Errorf("main: failed to adopt systemd sockets: %v", err)
+	}
+	for name := range socks.NamedListeners {
+		if _, ok := namedLns[name]; ok {
+			socks.Close()
+			return fmt.Errorf("main: duplicate listener name %s", name)
+		}
+	}
+	*lns = append(*lns, socks.Listeners...)
+	for name, ln := range socks.NamedListeners {
+		namedLns[name] = ln
+	}
+	*pcs = append(*pcs, socks.PacketConns...)
+	return nil
+}
+
+// parseListen parses the listen flag value.
+// e.g. 127.0.0.1:8000 => "", tcp, 127.0.0.1:8000. admin=unix:/tmp/app.sock => admin, unix, /tmp/app.sock
+func parseListen(l string) (name, network, addr string) {
+	if i := strings.Index(l, "="); i > 0 && !strings.ContainsAny(l[:i], ":/") {
+		name, l = l[:i], l[i+1:]
+	}
+	for _, n := range []string{"unix", "unixgram", "udp"} {
+		if strings.HasPrefix(l, n+":") {
+			return name, n, strings.TrimPrefix(l, n+":")
+		}
+	}
+	return name, "tcp", l
+}
+
+// removeStaleSocket removes the socket file left by a previous process.
+// the file is not removed if it is not a socket or someone is still listening on it.
+func removeStaleSocket(network, path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("main: failed to stat the socket file %s: %v", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("main: %s already exists and is not a socket", path)
+	}
+	if c, err := net.Dial(network, path); err == nil {
+		c.Close()
+		return fmt.Errorf("main: %s is already in use", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("main: failed to remove the stale socket file %s: %v", path, err)
+	}
+	return nil
 }
 
 func closeListeners(lns []net.Listener) {
@@ -93,3 +539,19 @@ func closeListeners(lns []net.Listener) {
 		}
 	}
 }
+
+func closeNamedListeners(lns map[string]net.Listener) {
+	for _, ln := range lns {
+		if err := ln.Close(); err != nil {
+			log.Printf("main: an error occurred when close the listener :%v", err)
+		}
+	}
+}
+
+func closePacketConns(pcs []net.PacketConn) {
+	for _, pc := range pcs {
+		if err := pc.Close(); err != nil {
+			log.Printf("main: an error occurred when close the packet conn :%v", err)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -21,14 +23,73 @@ func startGraceful() (*gp, error) {
 	if err != nil {
 		return nil, err
 	}
-	cmd := exec.Command("./graceful", "-l", addr, "--", "./stub_http")
+	return startGracefulListen(addr)
+}
+
+func startGracefulListen(listen string, moreListens ...string) (*gp, error) {
+	args := []string{"-l", listen}
+	for _, l := range moreListens {
+		args = append(args, "-l", l)
+	}
+	args = append(args, "--", "./stub_http")
+	return startGracefulArgs(listen, args...)
+}
+
+func startGracefulArgs(listen string, args ...string) (*gp, error) {
+	cmd := exec.Command("./graceful", args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
-	return &gp{cmd: cmd, listenAddr: addr}, nil
+	return &gp{cmd: cmd, listenAddr: listen}, nil
+}
+
+// startGracefulLogs starts the graceful, and returns the lines of its stderr, that are also written to os.Stderr
+func startGracefulLogs(listen string, args ...string) (*gp, <-chan string, error) {
+	cmd := exec.Command("./graceful", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	lines := make(chan string, 100)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			fmt.Fprintln(os.Stderr, sc.Text())
+			select {
+			case lines <- sc.Text():
+			default:
+			}
+		}
+	}()
+	return &gp{cmd: cmd, listenAddr: listen}, lines, nil
+}
+
+// waitLog waits for the line that contains the substr
+func waitLog(lines <-chan string, substr string, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return fmt.Errorf("the log %q is not written", substr)
+			}
+			if strings.Contains(line, substr) {
+				return nil
+			}
+		case <-timer.C:
+			return fmt.Errorf("the log %q is not written in %v", substr, timeout)
+		}
+	}
 }
 
 func (g *gp) stopGraceful(timeout time.Duration) error {
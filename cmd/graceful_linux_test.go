@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// parentPid returns the ppid of the process from /proc
+func parentPid(pid int) (int, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("invalid stat of process %d: %s", pid, s)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+func TestGraceful_Init(t *testing.T) {
+	addr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := startGracefulArgs(addr, "--init", "-l", addr, "--", "./stub_http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.cmd.Process.Kill()
+	process, err := findProcess(g.cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the orphan of the worker is reparented to the graceful, and reaped after it exits
+	pid, err := strconv.Atoi(strings.TrimSpace(testGetBody(t, fmt.Sprintf("http://%s/spawn", addr))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if ppid, err := parentPid(pid); err == nil && ppid == g.cmd.Process.Pid {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("process %d is not reparented to the graceful", pid)
+		}
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); syscall.Kill(pid, 0) != syscall.ESRCH; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("process %d is not reaped by the graceful", pid)
+		}
+	}
+
+	// the signals not handled by the graceful are forwarded to the worker
+	for _, sig := range []syscall.Signal{syscall.SIGUSR1, syscall.SIGXCPU} {
+		if err := g.cmd.Process.Signal(sig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := syscall.SIGUSR1.String() + "," + syscall.SIGXCPU.String()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		got := testGetBody(t, fmt.Sprintf("http://%s/signals", addr))
+		if got == want {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("signals got %q, want %q", got, want)
+		}
+	}
+
+	// SIGTERM shuts down the graceful and the worker
+	if err := g.stopGraceful(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(time.Second, append(process.childrenPids(), process.Pid())...); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,28 +1,36 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
 
 func init() {
-	goFiles := []string{
-		path.Join("testdata", "stub_http.go"),
-		path.Join("graceful.go"),
+	builds := [][]string{
+		{path.Join("testdata", "stub_http.go")},
+		// the graceful consists of the platform specific files
+		{"-o", "graceful", "."},
 	}
-	for _, f := range goFiles {
-		cmd := exec.Command("go", "build", f)
+	for _, args := range builds {
+		cmd := exec.Command("go", append([]string{"build"}, args...)...)
 		if err := cmd.Start(); err != nil {
-			log.Panicf("faield to build %s: %v", f, err)
+			log.Panicf("faield to build %s: %v", args, err)
 		}
 		if err := cmd.Wait(); err != nil {
-			log.Panicf("faield to build %s: %v", f, err)
+			log.Panicf("faield to build %s: %v", args, err)
 		}
 	}
 }
@@ -148,9 +156,325 @@ func TestGraceful_Restart_Multi(t *testing.T) {
 	}
 }
 
+func TestGraceful_Restart_Unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "stub;http.sock")
+
+	g, err := startGracefulListen("unix:" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := findProcess(g.cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	client := unixClient(sock)
+
+	testGetWith(t, client, "http://unix/ping")
+
+	if err := g.restartGraceful(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(10*time.Second, process.childrenPids()...); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the socket file must survive the old worker shutdown
+	testGetWith(t, client, "http://unix/ping")
+
+	if err := g.stopGraceful(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(time.Second, append(process.childrenPids(), process.Pid())...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGraceful_NamedListener(t *testing.T) {
+	addr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminAddr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := startGracefulListen("admin="+adminAddr, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := findProcess(g.cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	testGet(t, fmt.Sprintf("http://%s/ping", addr))
+	testGet(t, fmt.Sprintf("http://%s/ping", adminAddr))
+
+	if err := g.stopGraceful(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(time.Second, append(process.childrenPids(), process.Pid())...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGraceful_AutoRestart_CrashLoop(t *testing.T) {
+	addr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := startGracefulArgs(addr, "-l", addr, "--auto-restart-enabled",
+		"--auto-restart-backoff", "10ms", "--auto-restart-max", "3", "--", "false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- g.cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("graceful exited successfully, want the crash loop error")
+		}
+	case <-time.After(5 * time.Second):
+		g.cmd.Process.Kill()
+		t.Fatal("graceful did not exit in the crash loop")
+	}
+}
+
+func TestGraceful_ExitStatus(t *testing.T) {
+	addr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := startGracefulArgs(addr, "-l", addr, "--", "sh", "-c", "exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- g.cmd.Wait() }()
+	select {
+	case err := <-done:
+		ee, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("graceful exited with %v, want the exit status of the worker", err)
+		}
+		if code := ee.Sys().(syscall.WaitStatus).ExitStatus(); code != 3 {
+			t.Errorf("exit status got %v, want 3", code)
+		}
+	case <-time.After(5 * time.Second):
+		g.cmd.Process.Kill()
+		t.Fatal("graceful did not exit after the worker exited")
+	}
+}
+
+func TestGraceful_ListenFDsEnv(t *testing.T) {
+	addr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminAddr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := startGracefulArgs(addr, "--listen-fds-env", "-l", addr, "-l", "admin="+adminAddr, "--", "./stub_http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := findProcess(g.cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s", addr)
+	pid := testGetBody(t, base+"/pid")
+	if got := testGetBody(t, base+"/env?key=LISTEN_PID"); got != pid {
+		t.Errorf("LISTEN_PID got %q, want the pid of the worker %q", got, pid)
+	}
+	if got := testGetBody(t, base+"/env?key=LISTEN_FDS"); got != "2" {
+		t.Errorf("LISTEN_FDS got %q, want 2", got)
+	}
+	if got := testGetBody(t, base+"/env?key=LISTEN_FDNAMES"); got != "unknown:admin" {
+		t.Errorf("LISTEN_FDNAMES got %q, want unknown:admin", got)
+	}
+	if got := testGetBody(t, base+"/env?key=GRACEFUL_LISTEN_FDS_EXEC"); got != "" {
+		t.Errorf("GRACEFUL_LISTEN_FDS_EXEC got %q, want empty", got)
+	}
+
+	if err := g.stopGraceful(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(time.Second, append(process.childrenPids(), process.Pid())...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGraceful_ListenFDsEnv_NotHijacked(t *testing.T) {
+	// the worker that imports the library and inherits the env of the trampoline must run as is
+	addr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := startGracefulArgs(addr, "-l", addr, "-e", "GRACEFUL_LISTEN_FDS_EXEC=1", "--", "./stub_http", "/bin/false", "false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := findProcess(g.cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	testGet(t, fmt.Sprintf("http://%s/ping", addr))
+
+	if err := g.stopGraceful(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(time.Second, append(process.childrenPids(), process.Pid())...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestGraceful_Takeover(t *testing.T) {
+	addr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "graceful-takeover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "takeover.sock")
+
+	g1, err := startGracefulArgs(addr, "--takeover", sock, "-l", addr, "--", "./stub_http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process1, err := findProcess(g1.cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process1.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("http://%s", addr)
+	pid1 := testGetBody(t, base+"/pid")
+
+	// each request uses a new connection, so that the requests are accepted by both generations
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var requests, failures int32
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			atomic.AddInt32(&requests, 1)
+			res, err := client.Get(base + "/pid")
+			if err != nil {
+				atomic.AddInt32(&failures, 1)
+				t.Errorf("request failed during the takeover: %v", err)
+				continue
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				atomic.AddInt32(&failures, 1)
+				t.Errorf("status got %d during the takeover", res.StatusCode)
+			}
+		}
+	}()
+
+	g2, err := startGracefulArgs(addr, "--takeover", sock, "-l", addr, "--", "./stub_http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first graceful exits after the second one starts its worker
+	exited := make(chan error, 1)
+	go func() { exited <- g1.cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("the first graceful exits with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the first graceful does not exit after the takeover")
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n < 2 {
+		t.Errorf("requests got %d, want the requests during the takeover", n)
+	}
+
+	pid2 := testGetBody(t, base+"/pid")
+	if pid2 == pid1 || pid2 == "" {
+		t.Errorf("pid got %q, want the worker of the second graceful", pid2)
+	}
+	if err := waitNoProcess(time.Second, append(process1.childrenPids(), process1.Pid())...); err != nil {
+		t.Fatal(err)
+	}
+	if err := g2.stopGraceful(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func testGet(t *testing.T, url string) {
+	t.Helper()
+	testGetWith(t, http.DefaultClient, url)
+}
+
+func testGetBody(t *testing.T, url string) string {
 	t.Helper()
 	res, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	return string(b)
+}
+
+func testGetWith(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+	res, err := client.Get(url)
 	if err != nil {
 		t.Error(err)
 		return
@@ -160,3 +484,24 @@ func testGet(t *testing.T, url string) {
 		t.Errorf("response code got %v, want 200", res.StatusCode)
 	}
 }
+
+func TestSplitListenOptions(t *testing.T) {
+	tests := []struct {
+		in, listen, opts string
+	}{
+		{in: "127.0.0.1:8000", listen: "127.0.0.1:8000"},
+		{in: "127.0.0.1:8000?backlog=1024", listen: "127.0.0.1:8000", opts: "backlog=1024"},
+		{in: "admin=127.0.0.1:9000?backlog=1&keepalive=5s", listen: "admin=127.0.0.1:9000", opts: "backlog=1&keepalive=5s"},
+		{in: "unix:/tmp/app.sock", listen: "unix:/tmp/app.sock"},
+		{in: "unix:/tmp/a?b.sock?", listen: "unix:/tmp/a?b.sock"},
+		{in: "unix:/tmp/a?b.sock?backlog=1024", listen: "unix:/tmp/a?b.sock", opts: "backlog=1024"},
+		{in: "unixgram:/tmp/a?b?c.sock?", listen: "unixgram:/tmp/a?b?c.sock"},
+		{in: "127.0.0.1:8000?", listen: "127.0.0.1:8000"},
+	}
+	for _, tt := range tests {
+		listen, opts := splitListenOptions(tt.in)
+		if listen != tt.listen || opts != tt.opts {
+			t.Errorf("%s: got %q, %q, want %q, %q", tt.in, listen, opts, tt.listen, tt.opts)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGraceful_EnvDialect_Tableflip(t *testing.T) {
+	addr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the worker reads the listeners from the names of tableflip instead of GRACEFUL_LISTENERS
+	g, err := startGracefulArgs(addr, "--env-dialect", "tableflip", "--auto-restart-enabled", "-l", addr, "--",
+		"env", "-u", "GRACEFUL_LISTENERS", "-u", "GRACEFUL_LISTENERS_FDS", "./stub_http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := findProcess(g.cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	base := fmt.Sprintf("http://%s", addr)
+	if got := testGetBody(t, base+"/env?key=TABLEFLIP_HAS_PARENT_7f9c"); got != "yes" {
+		t.Errorf("TABLEFLIP_HAS_PARENT_7f9c got %q, want yes", got)
+	}
+
+	// the names are sent to the next generation, and the auto restarted process
+	if err := g.restartGraceful(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(10*time.Second, process.childrenPids()...); err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(testGetBody(t, base+"/pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(time.Second, pid); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, base+"/ping")
+
+	if err := g.stopGraceful(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(time.Second, append(process.childrenPids(), process.Pid())...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGraceful_Upgrade(t *testing.T) {
+	addr, err := freeTCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, logs, err := startGracefulLogs(addr, "-l", addr, "--", "./stub_http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := findProcess(g.cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitStartChildren(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("http://%s", addr)
+	pid := testGetBody(t, base+"/pid")
+
+	// the graceful re-executes itself in place and adopts the running worker
+	if err := g.cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitLog(logs, "adopted worker. pid="+pid, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the signals are handled right after the adoption
+	time.Sleep(100 * time.Millisecond)
+	if got := testGetBody(t, base+"/pid"); got != pid {
+		t.Errorf("pid got %s, want the adopted worker %s", got, pid)
+	}
+
+	// the upgraded graceful restarts the adopted worker
+	if err := g.restartGraceful(); err != nil {
+		t.Fatal(err)
+	}
+	oldPid, _ := strconv.Atoi(pid)
+	if err := waitNoProcess(10*time.Second, oldPid); err != nil {
+		t.Fatal(err)
+	}
+	newPid, err := strconv.Atoi(testGetBody(t, base+"/pid"))
+	if err != nil || newPid == oldPid {
+		t.Errorf("pid got %d, want the new worker", newPid)
+	}
+
+	if err := g.stopGraceful(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNoProcess(time.Second, newPid, process.Pid()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookupCredential(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	if cred, err := lookupCredential("", ""); err != nil || cred != nil {
+		t.Errorf("the credential got %+v, %v, want nil", cred, err)
+	}
+	tests := []struct {
+		user, group string
+	}{
+		{user: u.Username},
+		{user: u.Uid},
+		{group: g.Name},
+		{group: g.Gid},
+		{user: u.Username, group: g.Name},
+		{user: u.Uid, group: g.Gid},
+	}
+	for _, tt := range tests {
+		cred, err := lookupCredential(tt.user, tt.group)
+		if err != nil {
+			t.Errorf("user %q group %q: %v", tt.user, tt.group, err)
+			continue
+		}
+		if int(cred.Uid) != uid || int(cred.Gid) != gid {
+			t.Errorf("user %q group %q: uid %d gid %d, want %d %d", tt.user, tt.group, cred.Uid, cred.Gid, uid, gid)
+		}
+		if tt.user != "" && len(cred.Groups) == 0 {
+			t.Errorf("user %q: no supplementary groups", tt.user)
+		}
+	}
+
+	for _, tt := range []struct{ user, group string }{
+		{user: "graceful-no-such-user"},
+		{user: "4294967296"},
+		{group: "graceful-no-such-group"},
+		{group: "4294967296"},
+	} {
+		if _, err := lookupCredential(tt.user, tt.group); err == nil {
+			t.Errorf("user %q group %q: want the error of the unknown user", tt.user, tt.group)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// initForwardSignals returns the catchable signals that are forwarded to the worker in the init mode.
+// the signals to restart, shutdown and upgrade are not forwarded by the graceful
+func initForwardSignals() []os.Signal {
+	excluded := map[syscall.Signal]bool{
+		// can not be caught
+		syscall.SIGKILL: true,
+		syscall.SIGSTOP: true,
+		// the children are reaped by the graceful
+		syscall.SIGCHLD: true,
+		// used by the go runtime
+		syscall.SIGURG:  true,
+		syscall.SIGPROF: true,
+		syscall.SIGPIPE: true,
+		// the faults of the graceful itself
+		syscall.SIGABRT: true,
+		syscall.SIGBUS:  true,
+		syscall.SIGFPE:  true,
+		syscall.SIGILL:  true,
+		syscall.SIGSEGV: true,
+		syscall.SIGSYS:  true,
+		syscall.SIGTRAP: true,
+	}
+	sigs := make([]os.Signal, 0)
+	for sig := syscall.Signal(1); sig < 32; sig++ {
+		if !excluded[sig] {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// upgradeSignals returns the signals to re-exec the graceful
+func upgradeSignals() []os.Signal {
+	return []os.Signal{syscall.SIGUSR2}
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// initForwardSignals returns no signal, since the signals are not forwarded on this platform
+func initForwardSignals() []os.Signal {
+	return nil
+}
+
+// upgradeSignals returns no signal, since the upgrade is not supported on this platform
+func upgradeSignals() []os.Signal {
+	return nil
+}
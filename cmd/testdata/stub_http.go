@@ -5,7 +5,11 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -13,17 +17,84 @@ import (
 )
 
 func main() {
-	srv := http.Server{Handler: mux()}
-	go srv.Serve(listener())
+	go received.record()
+	nc := &newConns{conns: make(map[net.Conn]struct{})}
+	srv := http.Server{Handler: mux(), ConnState: nc.track}
+	lns := []net.Listener{listener()}
+	if ln, err := graceful.InheritedListener("admin"); err == nil {
+		lns = append(lns, ln)
+	}
+	for _, ln := range lns {
+		go srv.Serve(ln)
+	}
 
 	ch := make(chan os.Signal)
 	signal.Notify(ch, syscall.SIGTERM)
 	for range ch {
+		// Shutdown drops the requests read after it starts,
+		// so the accepted connections are read before that
+		for _, ln := range lns {
+			ln.Close()
+		}
+		nc.wait(time.Second)
 		srv.Shutdown(context.Background())
 		break
 	}
 }
 
+// received records the signals forwarded by the graceful
+var received = &signals{}
+
+type signals struct {
+	mu   sync.Mutex
+	sigs []string
+}
+
+func (s *signals) record() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGXCPU)
+	for sig := range ch {
+		s.mu.Lock()
+		s.sigs = append(s.sigs, sig.String())
+		s.mu.Unlock()
+	}
+}
+
+func (s *signals) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.sigs, ",")
+}
+
+// newConns tracks the connections that are accepted but not read yet
+type newConns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (n *newConns) track(c net.Conn, state http.ConnState) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if state == http.StateNew {
+		n.conns[c] = struct{}{}
+	} else {
+		delete(n.conns, c)
+	}
+}
+
+// wait waits until no connection is waiting to be read, or the timeout
+func (n *newConns) wait(timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		n.mu.Lock()
+		l := len(n.conns)
+		n.mu.Unlock()
+		if l == 0 {
+			return
+		}
+	}
+}
+
 func mux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -33,6 +104,24 @@ func mux() *http.ServeMux {
 		time.Sleep(time.Second)
 		w.WriteHeader(200)
 	}))
+	mux.Handle("/pid", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(os.Getpid())))
+	}))
+	mux.Handle("/env", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(os.Getenv(r.URL.Query().Get("key"))))
+	}))
+	mux.Handle("/signals", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(received.String()))
+	}))
+	// spawn starts the sleeper orphaned by the shell, and returns its pid
+	mux.Handle("/spawn", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, err := exec.Command("sh", "-c", "sleep 60 >/dev/null 2>&1 & echo $!").Output()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(out)
+	}))
 	return mux
 }
 
@@ -0,0 +1,341 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kei2100/go-graceful/supervisor"
+)
+
+// ConnHandoffListener wraps the listener so that the idle connections can be handed off
+// to the new worker generation on restart, instead of being closed by http.Server.Shutdown.
+// it also accepts the connections handed off by the old worker generation.
+//
+// set ConnState to the http.Server.ConnState so that the listener knows which connections are idle,
+// and call HandOff before http.Server.Shutdown.
+// the handoff must be enabled by the supervisor process (WithHandoffEnabled).
+//
+// only the plain tcp and unix connections are handed off, e.g. not the connections of tls.Listener.
+// the connections handed off by the old worker generation are accepted by the first ConnHandoffListener of the worker.
+type ConnHandoffListener struct {
+	net.Listener
+
+	connCh    chan net.Conn
+	errCh     chan error
+	done      chan struct{} // closed when the wrapped listener stops accepting
+	err       error
+	closed    chan struct{}
+	closeOnce sync.Once
+	receiver  *net.UnixConn
+
+	mu     sync.Mutex
+	conns  map[*handoffConn]struct{}
+	sender *net.UnixConn
+}
+
+// NewConnHandoffListener creates a new ConnHandoffListener.
+// this func only for worker process
+func NewConnHandoffListener(ln net.Listener) *ConnHandoffListener {
+	l := &ConnHandoffListener{
+		Listener: ln,
+		connCh:   make(chan net.Conn),
+		errCh:    make(chan error),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+		conns:    make(map[*handoffConn]struct{}),
+	}
+	go l.acceptLoop()
+	// receives the handoff sockets in advance, since HandOff does not wait for them
+	if err := startControl(); err != nil && err != ErrNoHandoff {
+		log.Println(err)
+	}
+	if receiver, err := connHandoffReceiver(); err == nil {
+		l.receiver = receiver
+		go l.receiveLoop(receiver)
+	} else if err != ErrNoHandoff {
+		log.Println(err)
+	}
+	return l
+}
+
+// Accept waits for and returns the next connection accepted by the wrapped listener,
+// or handed off by the old worker generation.
+func (l *ConnHandoffListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return l.track(c), nil
+	case err := <-l.errCh:
+		return nil, err
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close closes the wrapped listener and stops accepting the handed off connections
+func (l *ConnHandoffListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		if l.receiver != nil {
+			l.receiver.Close()
+		}
+	})
+	return l.Listener.Close()
+}
+
+// ConnState tracks the state of the connection. set this to the http.Server.ConnState
+func (l *ConnHandoffListener) ConnState(c net.Conn, state http.ConnState) {
+	hc, ok := c.(*handoffConn)
+	if !ok {
+		return
+	}
+	switch state {
+	case http.StateIdle:
+		hc.setIdle(true)
+		if l.handingOff() {
+			hc.startHandOff()
+		}
+	case http.StateActive:
+		hc.setIdle(false)
+	case http.StateHijacked, http.StateClosed:
+		l.untrack(hc)
+	}
+}
+
+// HandOff starts handing off the idle connections to the new worker generation.
+// the connections becoming idle after that are also handed off.
+// returns ErrNoHandoff if the new worker generation is not started by a restart.
+func (l *ConnHandoffListener) HandOff() error {
+	sender, err := connHandoffSender()
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.sender = sender
+	conns := make([]*handoffConn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+	for _, c := range conns {
+		c.startHandOff()
+	}
+	return nil
+}
+
+func (l *ConnHandoffListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				select {
+				case l.errCh <- err:
+					continue
+				case <-l.closed:
+				}
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		select {
+		case l.connCh <- c:
+		case <-l.closed:
+			c.Close()
+		}
+	}
+}
+
+// receiveLoop receives the connections handed off by the old worker generation,
+// until the old worker is stopped.
+func (l *ConnHandoffListener) receiveLoop(receiver *net.UnixConn) {
+	for {
+		files, err := receiveFiles(receiver, 1)
+		if err != nil {
+			return
+		}
+		for _, f := range files {
+			c, err := net.FileConn(f)
+			f.Close()
+			if err != nil {
+				log.Printf("graceful: failed to create the handed off connection: %v", err)
+				continue
+			}
+			select {
+			case l.connCh <- c:
+			case <-l.closed:
+				c.Close()
+			}
+		}
+	}
+}
+
+func (l *ConnHandoffListener) track(c net.Conn) net.Conn {
+	switch c.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		return c
+	}
+	hc := &handoffConn{Conn: c, l: l}
+	l.mu.Lock()
+	l.conns[hc] = struct{}{}
+	l.mu.Unlock()
+	return hc
+}
+
+func (l *ConnHandoffListener) untrack(c *handoffConn) {
+	l.mu.Lock()
+	delete(l.conns, c)
+	l.mu.Unlock()
+}
+
+func (l *ConnHandoffListener) handingOff() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sender != nil
+}
+
+// send sends the fd of the connection to the new worker generation
+func (l *ConnHandoffListener) send(c net.Conn) error {
+	l.mu.Lock()
+	sender := l.sender
+	l.mu.Unlock()
+	var f *os.File
+	var err error
+	switch c := c.(type) {
+	case *net.TCPConn:
+		f, err = c.File()
+	case *net.UnixConn:
+		f, err = c.File()
+	default:
+		return fmt.Errorf("graceful: can not hand off %T", c)
+	}
+	if err != nil {
+		return fmt.Errorf("graceful: failed to create the connection file: %v", err)
+	}
+	defer f.Close()
+	return sendFiles(sender, []*os.File{f})
+}
+
+// connHandoffReceiver returns the socket receiving the connections from the old worker generation.
+// only the first call gets the socket.
+func connHandoffReceiver() (*net.UnixConn, error) {
+	var conn *net.UnixConn
+	err := errConnHandoffReceiverUsed
+	connHandoffReceiverOnce.Do(func() {
+		conn, err = envUnixConn(supervisor.EnvConnHandoffFD)
+	})
+	return conn, err
+}
+
+var connHandoffReceiverOnce sync.Once
+
+var errConnHandoffReceiverUsed = errors.New("graceful: the handed off connections are accepted by another ConnHandoffListener")
+
+// handoff states of the handoffConn
+const (
+	handoffNone = iota
+	handoffPending
+	handoffDone
+)
+
+// handoffConn is the connection that can be handed off while it is idle.
+// the read of the idle connection is interrupted by the past deadline,
+// and the connection is handed off at the read or the close, without reading the next request.
+// pipelined requests already buffered by the http.Server are not taken into account.
+type handoffConn struct {
+	net.Conn
+	l *ConnHandoffListener
+
+	mu           sync.Mutex
+	idle         bool
+	handoff      int
+	readDeadline time.Time
+}
+
+func (c *handoffConn) Read(b []byte) (int, error) {
+	if c.tryHandOff() {
+		return 0, io.EOF
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.setIdle(false)
+		return n, err
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && c.tryHandOff() {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (c *handoffConn) Close() error {
+	c.tryHandOff()
+	return c.Conn.Close()
+}
+
+func (c *handoffConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline keeps the past deadline while handing off
+func (c *handoffConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.handoff != handoffNone {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *handoffConn) setIdle(idle bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle = idle
+	if !idle && c.handoff == handoffPending {
+		c.cancelHandOff()
+	}
+}
+
+// startHandOff interrupts the read of the idle connection
+func (c *handoffConn) startHandOff() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.idle || c.handoff != handoffNone {
+		return
+	}
+	c.handoff = handoffPending
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+// tryHandOff hands off the connection if it is pending.
+// reports whether the connection has been handed off.
+func (c *handoffConn) tryHandOff() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handoff != handoffPending {
+		return c.handoff == handoffDone
+	}
+	if err := c.l.send(c.Conn); err != nil {
+		log.Println(err)
+		c.cancelHandOff()
+		return false
+	}
+	c.handoff = handoffDone
+	return true
+}
+
+// cancelHandOff restores the read deadline. the caller must hold the mu.
+func (c *handoffConn) cancelHandOff() {
+	c.handoff = handoffNone
+	c.Conn.SetReadDeadline(c.readDeadline)
+}
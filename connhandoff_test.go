@@ -0,0 +1,36 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// envTestConnHandoff makes the test worker serve http, see testConnHandoffWorker
+const envTestConnHandoff = "GRACEFUL_TEST_CONN_HANDOFF"
+
+// testConnHandoffWorker serves the pid by http on the ConnHandoffListener,
+// and hands off the idle connections on SIGTERM
+func testConnHandoffWorker(ln net.Listener) {
+	l := NewConnHandoffListener(ln)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, os.Getpid())
+		}),
+		ConnState: l.ConnState,
+	}
+	go srv.Serve(l)
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	<-ch
+	l.HandOff()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
@@ -0,0 +1,77 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package graceful
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConnHandoffListener(t *testing.T) {
+	ln := listenTCP(t)
+	defer ln.Close()
+
+	g := NewGraceful()
+	done := serveTestWorker(t, g, WithListeners(ln), WithHandoffEnabled(true),
+		WithEnv(append(os.Environ(), envTestWorker+"=1", envTestConnHandoff+"=1")...))
+
+	var dials int32
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+			MaxIdleConnsPerHost: 1,
+		},
+		Timeout: 5 * time.Second,
+	}
+	url := "http://" + ln.Addr().String()
+	get := func() int {
+		t.Helper()
+		res, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pid, err := strconv.Atoi(string(b))
+		if err != nil {
+			t.Fatalf("invalid pid %q", b)
+		}
+		return pid
+	}
+
+	pid1 := get()
+	if err := g.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	// the idle connection is handed off before the old worker exits
+	for deadline := time.Now().Add(5 * time.Second); syscall.Kill(pid1, 0) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the old worker %d is not stopped", pid1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pid2 := get()
+	if pid2 == pid1 {
+		t.Errorf("pid got %d, want the new worker", pid2)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("dials got %d, want 1", n)
+	}
+	shutdownTestWorker(t, done)
+}
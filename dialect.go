@@ -0,0 +1,203 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EnvDialect is the convention of the environment variables to pass the listeners to the worker process
+type EnvDialect string
+
+const (
+	// EnvDialectServerStarter is the convention of Server::Starter (start_server).
+	// e.g. SERVER_STARTER_PORT=127.0.0.1:8080=3;/tmp/app.sock=4
+	EnvDialectServerStarter EnvDialect = "server-starter"
+	// EnvDialectEinhorn is the convention of Einhorn.
+	// e.g. EINHORN_FD_COUNT=2 EINHORN_FD_0=3 EINHORN_FD_1=4 EINHORN_FDS="3 4"
+	EnvDialectEinhorn EnvDialect = "einhorn"
+	// EnvDialectTableflip is the convention of tableflip.
+	// e.g. TABLEFLIP_HAS_PARENT_7f9c=yes, the names of the files at fd 4 and the files from fd 5
+	EnvDialectTableflip EnvDialect = "tableflip"
+)
+
+const (
+	envServerStarterPort = "SERVER_STARTER_PORT"
+	envEinhornFDCount    = "EINHORN_FD_COUNT"
+	envEinhornFDPrefix   = "EINHORN_FD_"
+	envEinhornFDs        = "EINHORN_FDS"
+)
+
+// ParseEnvDialect parses the name of EnvDialect
+func ParseEnvDialect(s string) (EnvDialect, error) {
+	switch d := EnvDialect(s); d {
+	case EnvDialectServerStarter, EnvDialectEinhorn, EnvDialectTableflip:
+		return d, nil
+	}
+	return "", fmt.Errorf("graceful: unknown env dialect %s", s)
+}
+
+// dialectEnv returns env vars of the dialect from the entries.
+// this func only for supervisor process
+func dialectEnv(d EnvDialect, entries []inheritedEntry) ([]string, error) {
+	switch d {
+	case EnvDialectServerStarter:
+		// Server::Starter passes only the stream sockets
+		ports := make([]string, 0, len(entries))
+		for _, e := range entries {
+			if isPacketNetwork(e.network) {
+				continue
+			}
+			ports = append(ports, fmt.Sprintf("%s=%d", e.addr, e.fd))
+		}
+		return []string{fmt.Sprintf("%s=%s", envServerStarterPort, strings.Join(ports, ";"))}, nil
+	case EnvDialectEinhorn:
+		env := []string{fmt.Sprintf("%s=%d", envEinhornFDCount, len(entries))}
+		fds := make([]string, 0, len(entries))
+		for i, e := range entries {
+			env = append(env, fmt.Sprintf("%s%d=%d", envEinhornFDPrefix, i, e.fd))
+			fds = append(fds, strconv.Itoa(int(e.fd)))
+		}
+		return append(env, fmt.Sprintf("%s=%s", envEinhornFDs, strings.Join(fds, " "))), nil
+	case EnvDialectTableflip:
+		// the names of the files are passed by the pipe of each worker generation, see tableflip
+		return []string{envTableflipSentinel + "=yes"}, nil
+	}
+	return nil, fmt.Errorf("graceful: unknown env dialect %s", d)
+}
+
+// dialectEntries lists the entries from the environment of
+// systemd socket activation, Server::Starter, Einhorn or tableflip, in this order.
+// the network and the addr of the entries are got from the sockets,
+// so the result is cached before the fds are consumed by the listeners.
+// this func only for worker process
+func dialectEntries() ([]inheritedEntry, error) {
+	dialectEntriesCache.once.Do(func() {
+		dialectEntriesCache.entries, dialectEntriesCache.err = loadDialectEntries()
+	})
+	return dialectEntriesCache.entries, dialectEntriesCache.err
+}
+
+var dialectEntriesCache struct {
+	once    sync.Once
+	entries []inheritedEntry
+	err     error
+}
+
+// hasDialectEnv reports whether the environment of the other supervisors is set
+func hasDialectEnv() bool {
+	return os.Getenv(envListenPID) == strconv.Itoa(os.Getpid()) ||
+		os.Getenv(envServerStarterPort) != "" ||
+		os.Getenv(envEinhornFDCount) != "" || os.Getenv(envEinhornFDs) != "" ||
+		os.Getenv(envTableflipSentinel) != ""
+}
+
+func hasEnvDialect(dialects []EnvDialect, d EnvDialect) bool {
+	for _, dd := range dialects {
+		if dd == d {
+			return true
+		}
+	}
+	return false
+}
+
+func loadDialectEntries() ([]inheritedEntry, error) {
+	var entries []inheritedEntry
+	var err error
+	switch {
+	case os.Getenv(envListenPID) == strconv.Itoa(os.Getpid()):
+		entries, err = systemdEntries()
+	case os.Getenv(envServerStarterPort) != "":
+		entries, err = serverStarterEntries()
+	case os.Getenv(envEinhornFDCount) != "" || os.Getenv(envEinhornFDs) != "":
+		entries, err = einhornEntries()
+	case os.Getenv(envTableflipSentinel) != "":
+		entries, err = tableflipEntries()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if err := entries[i].describe(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// serverStarterEntries lists the entries from SERVER_STARTER_PORT.
+// the separator ";" in a path is tolerated as long as the segment does not end with "=fd".
+func serverStarterEntries() ([]inheritedEntry, error) {
+	v := os.Getenv(envServerStarterPort)
+	entries := make([]inheritedEntry, 0)
+	var pending string
+	for _, s := range strings.Split(v, ";") {
+		s = pending + s
+		i := strings.LastIndex(s, "=")
+		if i < 0 {
+			pending = s + ";"
+			continue
+		}
+		fd, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			pending = s + ";"
+			continue
+		}
+		pending = ""
+		entries = append(entries, inheritedEntry{fd: uintptr(fd)})
+	}
+	if pending != "" {
+		return nil, fmt.Errorf("graceful: invalid %s %q", envServerStarterPort, v)
+	}
+	return entries, nil
+}
+
+func einhornEntries() ([]inheritedEntry, error) {
+	var fds []string
+	if v := os.Getenv(envEinhornFDCount); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("graceful: invalid %s %q", envEinhornFDCount, v)
+		}
+		for i := 0; i < n; i++ {
+			fds = append(fds, os.Getenv(fmt.Sprintf("%s%d", envEinhornFDPrefix, i)))
+		}
+	} else {
+		fds = strings.Fields(os.Getenv(envEinhornFDs))
+	}
+	entries := make([]inheritedEntry, 0, len(fds))
+	for _, s := range fds {
+		fd, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("graceful: invalid einhorn fd %q", s)
+		}
+		entries = append(entries, inheritedEntry{fd: uintptr(fd)})
+	}
+	return entries, nil
+}
+
+// describe fills the network and the addr of the entry from the socket.
+// the fd of the entry stays open.
+func (e *inheritedEntry) describe() error {
+	f, err := dupFD(e.fd)
+	if err != nil {
+		return fmt.Errorf("graceful: failed to dup fd %v: %v", e.fd, err)
+	}
+	defer f.Close()
+
+	var addr net.Addr
+	if ln, err := net.FileListener(f); err == nil {
+		addr = ln.Addr()
+		ln.Close()
+	} else if pc, err := net.FilePacketConn(f); err == nil {
+		addr = pc.LocalAddr()
+		pc.Close()
+	} else {
+		return fmt.Errorf("graceful: fd %v is not a socket: %v", e.fd, err)
+	}
+	e.network, e.addr = addr.Network(), addr.String()
+	return nil
+}
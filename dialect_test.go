@@ -0,0 +1,181 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestServerStarterEntries(t *testing.T) {
+	defer saveEnv(envServerStarterPort)()
+	tests := []struct {
+		env     string
+		want    []uintptr
+		wantErr bool
+	}{
+		{env: "127.0.0.1:8080=3", want: []uintptr{3}},
+		{env: "127.0.0.1:8080=3;/tmp/app.sock=4", want: []uintptr{3, 4}},
+		{env: "8080=5", want: []uintptr{5}},
+		{env: "/tmp/a;b.sock=3;[::1]:80=4", want: []uintptr{3, 4}},
+		{env: "/tmp/a=b.sock=3", want: []uintptr{3}},
+		{env: "127.0.0.1:8080", wantErr: true},
+		{env: "127.0.0.1:8080=x", wantErr: true},
+	}
+	for _, tt := range tests {
+		setenv(envServerStarterPort, tt.env)
+		entries, err := serverStarterEntries()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got %v", tt.env, entries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.env, err)
+			continue
+		}
+		if got := entryFDs(entries); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: fds got %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestEinhornEntries(t *testing.T) {
+	defer saveEnv(envEinhornFDCount, envEinhornFDs, envEinhornFDPrefix+"0", envEinhornFDPrefix+"1", envEinhornFDPrefix+"2")()
+	tests := []struct {
+		count   string
+		fdN     []string
+		fds     string
+		want    []uintptr
+		wantErr bool
+	}{
+		{fds: "3", want: []uintptr{3}},
+		{fds: "3 4 7", want: []uintptr{3, 4, 7}},
+		{count: "2", fdN: []string{"5", "6"}, want: []uintptr{5, 6}},
+		// EINHORN_FD_COUNT takes precedence
+		{count: "1", fdN: []string{"5"}, fds: "3 4", want: []uintptr{5}},
+		{count: "0", want: []uintptr{}},
+		{fds: "3 x", wantErr: true},
+		{count: "x", wantErr: true},
+		{count: "1", wantErr: true},
+	}
+	for _, tt := range tests {
+		setenv(envEinhornFDCount, tt.count)
+		setenv(envEinhornFDs, tt.fds)
+		for i := 0; i < 3; i++ {
+			v := ""
+			if i < len(tt.fdN) {
+				v = tt.fdN[i]
+			}
+			setenv(fmt.Sprintf("%s%d", envEinhornFDPrefix, i), v)
+		}
+		entries, err := einhornEntries()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%+v: want error, got %v", tt, entries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tt, err)
+			continue
+		}
+		if got := entryFDs(entries); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%+v: fds got %v, want %v", tt, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDialectEntries(t *testing.T) {
+	defer saveEnv(envServerStarterPort, envEinhornFDCount, envEinhornFDs)()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pf, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	setenv(envServerStarterPort, "")
+	setenv(envEinhornFDCount, "")
+	setenv(envEinhornFDs, fmt.Sprintf("%d %d", f.Fd(), pf.Fd()))
+	entries, err := loadDialectEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []inheritedEntry{
+		{network: "tcp", addr: ln.Addr().String(), fd: f.Fd()},
+		{network: "udp", addr: pc.LocalAddr().String(), fd: pf.Fd()},
+	}
+	if fmt.Sprint(entries) != fmt.Sprint(want) {
+		t.Errorf("entries got %+v, want %+v", entries, want)
+	}
+
+	setenv(envEinhornFDs, "")
+	setenv(envServerStarterPort, fmt.Sprintf("%s=%d", ln.Addr(), f.Fd()))
+	entries, err = loadDialectEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(entries) != fmt.Sprint(want[:1]) {
+		t.Errorf("entries got %+v, want %+v", entries, want[:1])
+	}
+
+	// the fd is not a socket
+	setenv(envServerStarterPort, fmt.Sprintf("%s=%d", ln.Addr(), os.Stdin.Fd()))
+	if _, err := loadDialectEntries(); err == nil {
+		t.Error("want error for the fd that is not a socket")
+	}
+}
+
+func entryFDs(entries []inheritedEntry) []uintptr {
+	fds := make([]uintptr, 0, len(entries))
+	for _, e := range entries {
+		fds = append(fds, e.fd)
+	}
+	return fds
+}
+
+// setenv sets the env var, unsets it if the value is empty
+func setenv(key, value string) {
+	if value == "" {
+		os.Unsetenv(key)
+		return
+	}
+	os.Setenv(key, value)
+}
+
+// saveEnv saves the env vars, and returns the func to restore them
+func saveEnv(keys ...string) func() {
+	saved := make(map[string]*string, len(keys))
+	for _, key := range keys {
+		if v, ok := os.LookupEnv(key); ok {
+			saved[key] = &v
+		} else {
+			saved[key] = nil
+		}
+	}
+	return func() {
+		for key, v := range saved {
+			if v == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *v)
+			}
+		}
+	}
+}
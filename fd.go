@@ -0,0 +1,28 @@
+package graceful
+
+import (
+	"fmt"
+)
+
+// InheritedFDError describes the mismatch between the fd inherited from the supervisor process
+// and the entry advertised by the supervisor process
+type InheritedFDError struct {
+	FD      uintptr
+	Network string // advertised by the supervisor process
+	Addr    string // advertised by the supervisor process
+
+	// ActualNetwork and ActualAddr are got from the fd.
+	// they are empty if the fd is not a socket.
+	ActualNetwork string
+	ActualAddr    string
+
+	Reason string
+}
+
+func (e *InheritedFDError) Error() string {
+	s := fmt.Sprintf("graceful: inherited fd %v (%s %s) %s", e.FD, e.Network, e.Addr, e.Reason)
+	if e.ActualNetwork != "" {
+		s += fmt.Sprintf(". actual %s %s", e.ActualNetwork, e.ActualAddr)
+	}
+	return s
+}
@@ -0,0 +1,166 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestValidateFD(t *testing.T) {
+	tcpLn := listenTCP(t)
+	defer tcpLn.Close()
+	tcpFile, err := tcpLn.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpFile.Close()
+
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "a=b;c.sock")
+	unixLn, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixLn.Close()
+	unixFile, err := unixLn.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixFile.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pcFile, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pcFile.Close()
+
+	conn, err := net.Dial("tcp", tcpLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connFile, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connFile.Close()
+
+	regular, err := ioutil.TempFile(dir, "regular")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regular.Close()
+
+	closed, err := ioutil.TempFile(dir, "closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedFD := closed.Fd()
+	closed.Close()
+
+	tests := []struct {
+		name       string
+		entry      inheritedEntry
+		wantReason string // empty if valid
+	}{
+		{name: "tcp", entry: inheritedEntry{network: "tcp", addr: tcpLn.Addr().String(), fd: tcpFile.Fd()}},
+		{name: "tcp4", entry: inheritedEntry{network: "tcp4", addr: tcpLn.Addr().String(), fd: tcpFile.Fd()}},
+		{name: "unix", entry: inheritedEntry{network: "unix", addr: sock, fd: unixFile.Fd()}},
+		{name: "udp", entry: inheritedEntry{network: "udp", addr: pc.LocalAddr().String(), fd: pcFile.Fd()}},
+		{name: "tcp other addr", entry: inheritedEntry{network: "tcp", addr: "127.0.0.1:1", fd: tcpFile.Fd()}, wantReason: "does not match the address"},
+		{name: "tcp as unix", entry: inheritedEntry{network: "unix", addr: tcpLn.Addr().String(), fd: tcpFile.Fd()}, wantReason: "does not match the network"},
+		{name: "udp as tcp", entry: inheritedEntry{network: "tcp", addr: pc.LocalAddr().String(), fd: pcFile.Fd()}, wantReason: "does not match the network"},
+		{name: "unix other path", entry: inheritedEntry{network: "unix", addr: sock + ".old", fd: unixFile.Fd()}, wantReason: "does not match the address"},
+		{name: "not listening", entry: inheritedEntry{network: "tcp", addr: conn.LocalAddr().String(), fd: connFile.Fd()}, wantReason: "is not listening"},
+		{name: "regular file", entry: inheritedEntry{network: "tcp", addr: tcpLn.Addr().String(), fd: regular.Fd()}, wantReason: "is not a socket"},
+		{name: "closed", entry: inheritedEntry{network: "tcp", addr: tcpLn.Addr().String(), fd: closedFD}, wantReason: "is not available"},
+	}
+	for _, tt := range tests {
+		err := validateFD(tt.entry)
+		if tt.wantReason == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		fdErr, ok := err.(*InheritedFDError)
+		if !ok {
+			t.Errorf("%s: got %v, want InheritedFDError", tt.name, err)
+			continue
+		}
+		if len(fdErr.Reason) < len(tt.wantReason) || fdErr.Reason[:len(tt.wantReason)] != tt.wantReason {
+			t.Errorf("%s: reason got %q, want %q", tt.name, fdErr.Reason, tt.wantReason)
+		}
+		if fdErr.FD != tt.entry.fd || fdErr.Network != tt.entry.network || fdErr.Addr != tt.entry.addr {
+			t.Errorf("%s: got %+v, want the advertised entry %+v", tt.name, fdErr, tt.entry)
+		}
+	}
+}
+
+func TestInheritedListeners_NoSupervisor(t *testing.T) {
+	defer saveEnv(supervisorEnvKeys...)()
+	for _, key := range supervisorEnvKeys {
+		os.Unsetenv(key)
+	}
+	if _, err := InheritedListeners(); err != ErrNoSupervisor {
+		t.Errorf("InheritedListeners got %v, want ErrNoSupervisor", err)
+	}
+	if _, err := InheritedListener("admin"); err != ErrNoSupervisor {
+		t.Errorf("InheritedListener got %v, want ErrNoSupervisor", err)
+	}
+	if _, err := InheritedPacketConns(); err != ErrNoSupervisor {
+		t.Errorf("InheritedPacketConns got %v, want ErrNoSupervisor", err)
+	}
+}
+
+func TestInheritedListeners_MismatchedFD(t *testing.T) {
+	defer saveEnv(supervisorEnvKeys...)()
+	for _, key := range supervisorEnvKeys {
+		os.Unsetenv(key)
+	}
+	ln := listenTCP(t)
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	other := listenTCP(t)
+	other.Close()
+	os.Setenv(envKey, inheritedEntry{network: "tcp", addr: other.Addr().String()}.String())
+	os.Setenv(envFDsKey, strconv.Itoa(int(f.Fd())))
+	_, err = InheritedListeners()
+	fdErr, ok := err.(*InheritedFDError)
+	if !ok {
+		t.Fatalf("got %v, want InheritedFDError", err)
+	}
+	if fdErr.ActualNetwork != "tcp" || fdErr.ActualAddr != ln.Addr().String() {
+		t.Errorf("actual got %s %s, want tcp %s", fdErr.ActualNetwork, fdErr.ActualAddr, ln.Addr())
+	}
+
+	os.Setenv(envKey, inheritedEntry{network: "tcp", addr: ln.Addr().String()}.String())
+	lns, err := InheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeListeners(lns)
+}
+
+// supervisorEnvKeys are the env keys that IsSupervised checks
+var supervisorEnvKeys = []string{
+	envKey, envFDsKey, envReusePortKey, envProxyKey,
+	envListenPID, envServerStarterPort, envEinhornFDCount, envEinhornFDs, envTableflipSentinel,
+}
@@ -0,0 +1,110 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// validateFD verifies that the fd of the entry is a socket of the advertised network and address,
+// and that it is listening if the network is stream oriented
+func validateFD(e inheritedEntry) error {
+	fdErr := func(reason string) *InheritedFDError {
+		return &InheritedFDError{FD: e.fd, Network: e.network, Addr: e.addr, Reason: reason}
+	}
+	fd := int(e.fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fdErr(fmt.Sprintf("is not available: %v", err))
+	}
+	if uint32(st.Mode)&syscall.S_IFMT != syscall.S_IFSOCK {
+		return fdErr("is not a socket")
+	}
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return fdErr(fmt.Sprintf("failed to get the socket type: %v", err))
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return fdErr(fmt.Sprintf("failed to getsockname: %v", err))
+	}
+	network, addr := sockaddrString(sa, typ)
+
+	mismatch := func(reason string) *InheritedFDError {
+		err := fdErr(reason)
+		err.ActualNetwork, err.ActualAddr = network, addr
+		return err
+	}
+	if network == "" || !sameNetwork(e.network, network) {
+		return mismatch("does not match the network")
+	}
+	if e.addr != addr {
+		return mismatch("does not match the address")
+	}
+	if typ == syscall.SOCK_STREAM || typ == syscall.SOCK_SEQPACKET {
+		accept, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+		if err != nil {
+			return mismatch(fmt.Sprintf("failed to get SO_ACCEPTCONN: %v", err))
+		}
+		if accept == 0 {
+			return mismatch("is not listening")
+		}
+	}
+	return nil
+}
+
+// sockaddrString returns the network and the address in the same form as net.Addr
+func sockaddrString(sa syscall.Sockaddr, typ int) (network, addr string) {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return inetNetwork(typ), net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrInet6:
+		host := net.IP(sa.Addr[:]).String()
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				host += "%" + ifi.Name
+			} else {
+				host += "%" + strconv.Itoa(int(sa.ZoneId))
+			}
+		}
+		return inetNetwork(typ), net.JoinHostPort(host, strconv.Itoa(sa.Port))
+	case *syscall.SockaddrUnix:
+		switch typ {
+		case syscall.SOCK_STREAM:
+			return "unix", sa.Name
+		case syscall.SOCK_DGRAM:
+			return "unixgram", sa.Name
+		case syscall.SOCK_SEQPACKET:
+			return "unixpacket", sa.Name
+		}
+	}
+	return "", ""
+}
+
+func inetNetwork(typ int) string {
+	switch typ {
+	case syscall.SOCK_STREAM:
+		return "tcp"
+	case syscall.SOCK_DGRAM:
+		return "udp"
+	}
+	return ""
+}
+
+// dupFD duplicates the fd with the close-on-exec flag, so that the fd stays open after the file is closed
+func dupFD(fd uintptr) (*os.File, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	dup, err := syscall.Dup(int(fd))
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(dup)
+	return os.NewFile(uintptr(dup), ""), nil
+}
@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// validateFD does not verify the fd on this platform
+func validateFD(e inheritedEntry) error {
+	return nil
+}
+
+// dupFD is not supported on this platform
+func dupFD(fd uintptr) (*os.File, error) {
+	return nil, fmt.Errorf("duplicating the fd is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,113 @@
+package graceful
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// envFilesKey is the env key of the named files passed to the worker process.
+// e.g. GRACEFUL_FILES=audit=5;lock=6
+const envFilesKey = "GRACEFUL_FILES"
+
+// InheritedFile returns the file named by the supervisor process (WithFiles).
+// the same *os.File is returned for the same name, so the file must not be closed while it is used.
+// returns ErrNoSupervisor if this process is not started by a supervisor process.
+// this func only for worker process
+func InheritedFile(name string) (*os.File, error) {
+	inheritedFiles.mu.Lock()
+	if inheritedFiles.files == nil {
+		inheritedFiles.files = make(map[string]*inheritedFile)
+	}
+	f, ok := inheritedFiles.files[name]
+	if !ok {
+		f = &inheritedFile{}
+		inheritedFiles.files[name] = f
+	}
+	inheritedFiles.mu.Unlock()
+
+	f.once.Do(func() {
+		f.file, f.err = loadInheritedFile(name)
+	})
+	return f.file, f.err
+}
+
+// inheritedFiles caches the files by name, so that an fd is owned by only one *os.File
+var inheritedFiles struct {
+	mu    sync.Mutex
+	files map[string]*inheritedFile
+}
+
+type inheritedFile struct {
+	once sync.Once
+	file *os.File
+	err  error
+}
+
+func loadInheritedFile(name string) (*os.File, error) {
+	v, ok := os.LookupEnv(envFilesKey)
+	if !ok && !IsSupervised() {
+		return nil, ErrNoSupervisor
+	}
+	if v == "" {
+		return nil, fmt.Errorf("graceful: file %s is not inherited", name)
+	}
+	for _, s := range strings.Split(v, envSep) {
+		i := strings.LastIndex(s, nameSep)
+		if i < 0 {
+			return nil, fmt.Errorf("graceful: invalid %s %q", envFilesKey, v)
+		}
+		n, err := url.QueryUnescape(s[:i])
+		if err != nil {
+			return nil, fmt.Errorf("graceful: failed to unescape the inherited file name %s: %v", s, err)
+		}
+		if n != name {
+			continue
+		}
+		fd, err := strconv.Atoi(s[i+len(nameSep):])
+		if err != nil {
+			return nil, fmt.Errorf("graceful: invalid %s %q", envFilesKey, v)
+		}
+		if err := validateFileFD(fd); err != nil {
+			return nil, &InheritedFDError{FD: uintptr(fd), Network: "file", Addr: name, Reason: fmt.Sprintf("is not available: %v", err)}
+		}
+		return os.NewFile(uintptr(fd), name), nil
+	}
+	return nil, fmt.Errorf("graceful: file %s is not inherited", name)
+}
+
+// createNamedFiles duplicates the named files to pass them to the worker process, sorted by name.
+// the fds in the worker process start from firstFD.
+// this func only for supervisor process
+func createNamedFiles(files map[string]*os.File, firstFD int) ([]*os.File, []string, error) {
+	if len(files) == 0 {
+		return nil, nil, nil
+	}
+	names := sortedFileNames(files)
+
+	dups := make([]*os.File, 0, len(names))
+	ss := make([]string, 0, len(names))
+	for i, name := range names {
+		dup, err := dupFile(files[name], name)
+		if err != nil {
+			closeListenerFiles(dups)
+			return nil, nil, fmt.Errorf("graceful: failed to dup the file %s: %v", name, err)
+		}
+		dups = append(dups, dup)
+		ss = append(ss, fmt.Sprintf("%s%s%d", url.QueryEscape(name), nameSep, firstFD+i))
+	}
+	return dups, []string{fmt.Sprintf("%s=%s", envFilesKey, strings.Join(ss, envSep))}, nil
+}
+
+func sortedFileNames(files map[string]*os.File) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,73 @@
+package graceful
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+)
+
+// resetInheritedFiles clears the cache of InheritedFile
+func resetInheritedFiles() {
+	inheritedFiles.mu.Lock()
+	inheritedFiles.files = nil
+	inheritedFiles.mu.Unlock()
+}
+
+func TestInheritedFile(t *testing.T) {
+	defer saveEnv(append(supervisorEnvKeys, envFilesKey)...)()
+	defer resetInheritedFiles()
+	resetInheritedFiles()
+
+	f, err := ioutil.TempFile("", "graceful-file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString("hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	name := "a=b;c:d%e"
+	setenv(envKey, "")
+	setenv(envFilesKey, fmt.Sprintf("other%s%d%s%s%s%d", nameSep, 1000, envSep, url.QueryEscape(name), nameSep, f.Fd()))
+
+	got, err := InheritedFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Fd() != f.Fd() {
+		t.Errorf("fd got %d, want %d", got.Fd(), f.Fd())
+	}
+	again, err := InheritedFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != got {
+		t.Errorf("InheritedFile returned another *os.File for the same name")
+	}
+
+	if _, err := InheritedFile("missing"); err == nil {
+		t.Errorf("InheritedFile of the missing name got no error")
+	}
+	if _, err := InheritedFile("other"); err == nil {
+		t.Errorf("InheritedFile of the closed fd got no error")
+	} else if _, ok := err.(*InheritedFDError); !ok {
+		t.Errorf("InheritedFile of the closed fd got %T, want *InheritedFDError", err)
+	}
+}
+
+func TestInheritedFile_NoSupervisor(t *testing.T) {
+	defer saveEnv(append(supervisorEnvKeys, envFilesKey)...)()
+	defer resetInheritedFiles()
+	resetInheritedFiles()
+
+	for _, key := range append(supervisorEnvKeys, envFilesKey) {
+		os.Unsetenv(key)
+	}
+	if _, err := InheritedFile("a"); err != ErrNoSupervisor {
+		t.Errorf("InheritedFile got %v, want ErrNoSupervisor", err)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package graceful
+
+import (
+	"os"
+	"syscall"
+)
+
+// validateFileFD verifies that the fd is open
+func validateFileFD(fd int) error {
+	var st syscall.Stat_t
+	return syscall.Fstat(fd, &st)
+}
+
+// dupFile duplicates the file with the close-on-exec flag
+func dupFile(f *os.File, name string) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// socketFile duplicates the fd of the socket with the close-on-exec flag.
+// unlike the File method of the socket, Fd of the returned file does not put the fd into blocking mode,
+// which would block the accept of the workers sharing the socket
+func socketFile(c syscall.Conn, name string) (*os.File, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	var dupErr error
+	syscall.ForkLock.RLock()
+	err = rc.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+		if dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, dupErr
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
@@ -0,0 +1,30 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// validateFileFD does not verify the fd on this platform
+func validateFileFD(fd int) error {
+	return nil
+}
+
+// dupFile is not supported on this platform, since the files can not be passed to the worker process
+func dupFile(f *os.File, name string) (*os.File, error) {
+	return nil, fmt.Errorf("passing the files is not supported on %s", runtime.GOOS)
+}
+
+// socketFile duplicates the fd of the socket
+func socketFile(c syscall.Conn, name string) (*os.File, error) {
+	s, ok := c.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("not implemented %T", c)
+	}
+	return s.File()
+}
@@ -1,11 +1,16 @@
 package graceful
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"net"
 	"os"
 	"os/signal"
+	"sync"
 
 	"github.com/kei2100/go-graceful/supervisor"
+	"github.com/kei2100/go-graceful/worker"
 )
 
 // Serve executes given command
@@ -20,12 +25,44 @@ func Restart() error {
 	return graceful.Restart()
 }
 
+// Upgrade re-executes the executable of the supervisor process without stopping the worker
+func Upgrade() error {
+	return graceful.Upgrade()
+}
+
+// InFlight returns the number of the in-flight requests of the current and the previous worker generation in the proxy mode
+func InFlight() (current, old int) {
+	return graceful.InFlight()
+}
+
+// AddListener adds the listener and graceful restarts
+func AddListener(ln net.Listener) error {
+	return graceful.AddListener(ln)
+}
+
+// AddNamedListener adds the named listener and graceful restarts
+func AddNamedListener(name string, ln net.Listener) error {
+	return graceful.AddNamedListener(name, ln)
+}
+
+// RemoveListener removes the listener and graceful restarts
+func RemoveListener(ln net.Listener) error {
+	return graceful.RemoveListener(ln)
+}
+
 var graceful = NewGraceful()
 
 // Graceful restart engine
 type Graceful struct {
 	manualRestartCh   chan struct{}
 	manualRestartedCh chan error
+	manualUpgradeCh   chan struct{}
+	manualUpgradedCh  chan error
+	updateCh          chan func(o *option) error
+	updatedCh         chan error
+
+	mu    sync.Mutex
+	proxy *proxy // the proxy of the serving supervisor process, nil if not in the proxy mode
 }
 
 // NewGraceful creates a new Graceful
@@ -33,35 +70,109 @@ func NewGraceful() *Graceful {
 	return &Graceful{
 		manualRestartCh:   make(chan struct{}),
 		manualRestartedCh: make(chan error),
+		manualUpgradeCh:   make(chan struct{}),
+		manualUpgradedCh:  make(chan error),
+		updateCh:          make(chan func(o *option) error),
+		updatedCh:         make(chan error),
 	}
 }
 
 // Serve executes given command
 // and graceful restarts when the restart signal received.
 // default restart signal is HUP.
+// returns worker.ExitError if the worker exits unsuccessfully by itself,
+// or worker.CrashLoopError if the auto restarted worker is in the crash loop.
 func (g *Graceful) Serve(command string, opts ...OptionFunc) error {
 	o := &option{}
 	o.applyOrDefault(opts)
 
-	extraFiles, err := createListenerFiles(o.listeners)
+	if os.Getenv(envListenFDsExec) != "" {
+		// the supervisor started by the supervisor with WithListenFDsEnvEnabled would start the supervisor again
+		return fmt.Errorf("graceful: the process is started to exec the worker, RunListenFDsTrampoline must be called at the beginning of the main")
+	}
+	workerPid, upgraded, err := upgradedWorkerPid()
+	if err != nil {
+		return err
+	}
+	if upgraded {
+		o.env = filterEnv(o.env, upgradeEnvKeys)
+	}
+	attr, err := newProcessAttr(command, o)
 	if err != nil {
 		return err
 	}
-	defer closeListenerFiles(extraFiles)
+	defer func() { closeListenerFiles(attr.extraFiles) }()
+
+	waitReadyFunc := o.waitReadyFunc
+	if rpEntries := createReusePortEntries(o); len(rpEntries) > 0 {
+		waitReadyFunc = reusePortWaitReadyFunc(rpEntries, waitReadyFunc)
+	}
+	var generationEnvFunc func() ([]string, error)
+	var waitIdleFunc func(context.Context) error
+	if o.proxyNetwork != "" {
+		if upgraded {
+			return fmt.Errorf("graceful: the worker can not be adopted in the proxy mode")
+		}
+		px, err := newProxy(o.proxyNetwork, o)
+		if err != nil {
+			return err
+		}
+		defer px.close()
+		px.serve()
+		g.setProxy(px)
+		defer g.setProxy(nil)
+		waitReadyFunc = px.waitReadyFunc(waitReadyFunc)
+		generationEnvFunc = px.generationEnv
+		if px.http {
+			waitIdleFunc = px.waitIdle
+		}
+	}
+	if o.takeover != nil {
+		waitReadyFunc = takeoverWaitReadyFunc(o.takeover, waitReadyFunc)
+	}
+	var generationFilesFunc func() ([]*os.File, error)
+	var tf *tableflip
+	if attr.tableflipNames != nil {
+		// the names are sent first, the worker of tableflip does not start without them
+		tf = &tableflip{names: attr.tableflipNames}
+		waitReadyFunc = tf.waitReadyFunc(waitReadyFunc)
+		generationFilesFunc = tf.generationFiles
+	}
+	var takeoverCh chan takeoverRequest
+	if o.takeoverSocket != "" {
+		takeoverCh = make(chan takeoverRequest)
+		ts, err := startTakeoverServer(o.takeoverSocket, o.takeover, takeoverCh)
+		if err != nil {
+			return err
+		}
+		defer ts.close()
+	}
 
 	sv := &supervisor.Supervisor{
-		Command:            command,
-		Args:               o.args,
-		ExtraFiles:         extraFiles,
-		Env:                append(o.env, listenersEnv(o.listeners)),
-		WaitReadyFunc:      o.waitReadyFunc,
-		AutoRestartEnabled: o.autoRestartEnabled,
-		StartTimeout:       o.startTimeout,
-		StopOldDelay:       o.stopOldDelay,
+		Command:             attr.command,
+		Args:                attr.args,
+		ExtraFiles:          attr.extraFiles,
+		Env:                 attr.env,
+		WaitReadyFunc:       waitReadyFunc,
+		AutoRestartEnabled:  o.autoRestartEnabled,
+		RestartPolicy:       o.restartPolicy,
+		StartTimeout:        o.startTimeout,
+		StopOldDelay:        o.stopOldDelay,
+		HandoffEnabled:      o.handoffEnabled,
+		GenerationEnvFunc:   generationEnvFunc,
+		GenerationFilesFunc: generationFilesFunc,
+		WaitIdleFunc:        waitIdleFunc,
+		SubreaperEnabled:    o.subreaperEnabled,
+		Credential:          o.credential,
 	}
 	done := make(chan error)
 	go func() {
-		err := start(sv, o)
+		var err error
+		if upgraded {
+			err = adopt(sv, workerPid)
+		} else {
+			err = start(sv, o)
+		}
 		done <- err
 		close(done)
 	}()
@@ -70,6 +181,14 @@ func (g *Graceful) Serve(command string, opts ...OptionFunc) error {
 	signal.Notify(restartCh, o.restartSignals...)
 	shutdownCh := make(chan os.Signal, 1) // buffer 1. to be able to receive shutdown signal even during restart
 	signal.Notify(shutdownCh, o.shutdownSignals...)
+	upgradeCh := make(chan os.Signal, 1)
+	if len(o.upgradeSignals) > 0 {
+		signal.Notify(upgradeCh, o.upgradeSignals...)
+	}
+	forwardCh := make(chan os.Signal, 1)
+	if sigs := forwardSignals(o); len(sigs) > 0 {
+		signal.Notify(forwardCh, sigs...)
+	}
 
 	for {
 		select {
@@ -82,6 +201,51 @@ func (g *Graceful) Serve(command string, opts ...OptionFunc) error {
 		case <-g.manualRestartCh:
 			err := restart(sv, o)
 			g.manualRestartedCh <- err
+		case <-upgradeCh:
+			if err := upgrade(sv, o); err != nil {
+				log.Println(err)
+			}
+		case sig := <-forwardCh:
+			if err := sv.Signal(sig); err != nil {
+				log.Println(err)
+			}
+		case <-g.manualUpgradeCh:
+			g.manualUpgradedCh <- upgrade(sv, o)
+		case update := <-g.updateCh:
+			lns, named := o.listeners, o.namedListeners
+			newAttr, err := updateListeners(sv, command, o, update)
+			if err != nil {
+				g.updatedCh <- err
+				continue
+			}
+			if tf != nil {
+				tf.setNames(newAttr.tableflipNames)
+			}
+			if err := restart(sv, o); err != nil {
+				// the old worker keeps running, and it may be auto restarted with the files of the previous generation
+				o.listeners, o.namedListeners = lns, named
+				sv.SetProcessAttr(attr.command, attr.args, attr.extraFiles, attr.env)
+				if tf != nil {
+					tf.setNames(attr.tableflipNames)
+				}
+				closeListenerFiles(newAttr.extraFiles)
+				g.updatedCh <- err
+				continue
+			}
+			// the old worker has been stopped, so the files of the previous generation are no longer needed
+			closeListenerFiles(attr.extraFiles)
+			attr = newAttr
+			g.updatedCh <- nil
+		case req := <-takeoverCh:
+			if !req.drain {
+				files, entries, err := createExtraFiles(o)
+				req.replyCh <- takeoverReply{files: files, entries: entries, err: err}
+				continue
+			}
+			// the new supervisor process owns the socket files from now on
+			keepSocketFiles(o)
+			req.replyCh <- takeoverReply{}
+			return shutdown(sv, o.gracefulStopSignal, o)
 		case sig := <-shutdownCh:
 			return shutdown(sv, sig, o)
 		}
@@ -94,16 +258,228 @@ func (g *Graceful) Restart() error {
 	return <-g.manualRestartedCh
 }
 
+// Upgrade re-executes the executable of the supervisor process, that may be replaced with a new version,
+// without stopping the worker. the listeners and the pid of the worker are passed to the new image,
+// and the Serve of the new image adopts the worker. the new image should get the listeners with UpgradedListeners.
+// the upgrade is refused with the proxy mode, WithFiles, WithHandoffEnabled or EnvDialectTableflip,
+// since their state is not passed to the new image.
+// returns only if the re-exec fails.
+func (g *Graceful) Upgrade() error {
+	g.manualUpgradeCh <- struct{}{}
+	return <-g.manualUpgradedCh
+}
+
+// InFlight returns the number of the in-flight requests of the current and the previous worker generation
+// in the proxy mode. the previous generation is counted until it is stopped.
+// in the tcp and unix proxy mode, the proxied connections are counted instead of the requests.
+// returns 0, 0 if Serve is not running in the proxy mode.
+func (g *Graceful) InFlight() (current, old int) {
+	g.mu.Lock()
+	px := g.proxy
+	g.mu.Unlock()
+	if px == nil {
+		return 0, 0
+	}
+	return px.inFlight()
+}
+
+func (g *Graceful) setProxy(px *proxy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.proxy = px
+}
+
+// AddListener adds the listener and graceful restarts,
+// so that the next worker generation inherits the listener.
+// the listener is not added if the restart fails.
+func (g *Graceful) AddListener(ln net.Listener) error {
+	return g.update(func(o *option) error {
+		o.listeners = append(append([]net.Listener{}, o.listeners...), ln)
+		return nil
+	})
+}
+
+// AddNamedListener adds the named listener and graceful restarts,
+// so that the next worker generation inherits the listener.
+// the listener is not added if the restart fails.
+func (g *Graceful) AddNamedListener(name string, ln net.Listener) error {
+	return g.update(func(o *option) error {
+		if _, ok := o.namedListeners[name]; ok {
+			return fmt.Errorf("graceful: listener %s already exists", name)
+		}
+		named := make(map[string]net.Listener, len(o.namedListeners)+1)
+		for n, l := range o.namedListeners {
+			named[n] = l
+		}
+		named[name] = ln
+		o.namedListeners = named
+		return nil
+	})
+}
+
+// RemoveListener removes the listener and graceful restarts,
+// so that the next worker generation does not inherit the listener.
+// the listener is not closed, and not removed if the restart fails.
+func (g *Graceful) RemoveListener(ln net.Listener) error {
+	return g.update(func(o *option) error {
+		lns := make([]net.Listener, 0, len(o.listeners))
+		for _, l := range o.listeners {
+			if l != ln {
+				lns = append(lns, l)
+			}
+		}
+		named := make(map[string]net.Listener, len(o.namedListeners))
+		for n, l := range o.namedListeners {
+			if l != ln {
+				named[n] = l
+			}
+		}
+		if len(lns) == len(o.listeners) && len(named) == len(o.namedListeners) {
+			return fmt.Errorf("graceful: listener %v not found", ln.Addr())
+		}
+		o.listeners, o.namedListeners = lns, named
+		return nil
+	})
+}
+
+func (g *Graceful) update(f func(o *option) error) error {
+	g.updateCh <- f
+	return <-g.updatedCh
+}
+
+// processAttr represents the attributes of the worker process derived from the options
+type processAttr struct {
+	command    string
+	args       []string
+	env        []string
+	extraFiles []*os.File
+
+	// tableflipNames is the names of the extra files in the tableflip env dialect, nil if it is not used
+	tableflipNames [][]string
+}
+
+func newProcessAttr(command string, o *option) (*processAttr, error) {
+	lo := o
+	if o.proxyNetwork != "" {
+		// the supervisor process accepts on the listeners in the proxy mode, so the worker does not inherit them
+		po := *o
+		po.listeners, po.namedListeners = nil, nil
+		lo = &po
+	}
+	tableflipEnabled := hasEnvDialect(o.envDialects, EnvDialectTableflip)
+	if tableflipEnabled && o.listenFDsEnvEnabled {
+		return nil, fmt.Errorf("graceful: the tableflip env dialect can not be used with LISTEN_FDS")
+	}
+	extraFiles, entries, err := createExtraFiles(lo)
+	if err != nil {
+		return nil, err
+	}
+	firstFD := 3
+	if tableflipEnabled {
+		// the fds 3 and 4 are the pipes of each worker generation
+		firstFD = tableflipFirstFD
+		for i := range entries {
+			entries[i].fd = uintptr(firstFD + i)
+		}
+	}
+	lnsEnv, err := listenersEnv(entries, o.envDialects)
+	if err != nil {
+		closeListenerFiles(extraFiles)
+		return nil, err
+	}
+	files, filesEnv, err := createNamedFiles(o.files, firstFD+len(extraFiles))
+	if err != nil {
+		closeListenerFiles(extraFiles)
+		return nil, err
+	}
+	args, env := o.args, append(append([]string{}, o.env...), lnsEnv...)
+	env = append(env, filesEnv...)
+	env = append(env, tlsFilesEnv(o.tlsCertFile, o.tlsKeyFile)...)
+	env = append(env, reusePortEnv(createReusePortEntries(o))...)
+	if o.listenFDsEnvEnabled {
+		command, args, env, err = listenFDsCommand(command, args, env, entries)
+		if err != nil {
+			closeListenerFiles(extraFiles)
+			closeListenerFiles(files)
+			return nil, err
+		}
+	}
+	attr := &processAttr{command: command, args: args, env: env, extraFiles: append(extraFiles, files...)}
+	if tableflipEnabled {
+		attr.tableflipNames = tableflipNames(entries, sortedFileNames(o.files))
+	}
+	return attr, nil
+}
+
+// updateListeners applies the update to the options and the supervisor.
+// the options are not changed if the update fails.
+func updateListeners(sv *supervisor.Supervisor, command string, o *option, update func(o *option) error) (*processAttr, error) {
+	if o.proxyNetwork != "" {
+		return nil, fmt.Errorf("graceful: listeners can not be updated in the proxy mode")
+	}
+	lns, named := o.listeners, o.namedListeners
+	if err := update(o); err != nil {
+		return nil, err
+	}
+	attr, err := newProcessAttr(command, o)
+	if err != nil {
+		o.listeners, o.namedListeners = lns, named
+		return nil, err
+	}
+	sv.SetProcessAttr(attr.command, attr.args, attr.extraFiles, attr.env)
+	return attr, nil
+}
+
 func start(sv *supervisor.Supervisor, o *option) error {
 	ctx, can := o.startContext()
 	defer can()
 	err := sv.Start(ctx)
+	if isWorkerError(err) {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("supervisor: failed to start process: %v", err)
 	}
 	return nil
 }
 
+func adopt(sv *supervisor.Supervisor, pid int) error {
+	err := sv.Adopt(pid)
+	if isWorkerError(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("supervisor: failed to adopt process: %v", err)
+	}
+	return nil
+}
+
+// forwardSignals returns the forward signals other than the signals to restart, shutdown and upgrade
+func forwardSignals(o *option) []os.Signal {
+	handled := make(map[os.Signal]bool)
+	for _, sigs := range [][]os.Signal{o.restartSignals, o.shutdownSignals, o.upgradeSignals} {
+		for _, sig := range sigs {
+			handled[sig] = true
+		}
+	}
+	sigs := make([]os.Signal, 0, len(o.forwardSignals))
+	for _, sig := range o.forwardSignals {
+		if !handled[sig] {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// isWorkerError reports whether the error is the reason why the worker is done by itself
+func isWorkerError(err error) bool {
+	switch err.(type) {
+	case *worker.ExitError, *worker.CrashLoopError:
+		return true
+	}
+	return false
+}
+
 func restart(sv *supervisor.Supervisor, o *option) error {
 	ctx, can := o.restartContext()
 	defer can()
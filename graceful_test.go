@@ -0,0 +1,242 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// envTestWorker makes the test binary run as the worker process, see testWorker
+const envTestWorker = "GRACEFUL_TEST_WORKER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envTestWorker) != "" {
+		testWorker()
+		return
+	}
+	if os.Getenv(envTestSystemd) != "" {
+		testSystemdWorker()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// envTestBindDelay delays the test worker to bind the listeners by the duration, see testWorker
+const envTestBindDelay = "GRACEFUL_TEST_BIND_DELAY"
+
+// envTestHandoff makes the test worker hand off its state, see testHandoff
+const envTestHandoff = "GRACEFUL_TEST_HANDOFF"
+
+// testWorker writes its pid to the connections accepted on the inherited listeners.
+// the state received from the old worker generation follows the pid if envTestHandoff is set.
+func testWorker() {
+	if d, err := time.ParseDuration(os.Getenv(envTestBindDelay)); err == nil {
+		time.Sleep(d)
+	}
+	lns, err := InheritedListeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if os.Getenv(envTestConnHandoff) != "" {
+		testConnHandoffWorker(lns[0])
+		return
+	}
+	reply := strconv.Itoa(os.Getpid())
+	var sent chan struct{}
+	if os.Getenv(envTestHandoff) != "" {
+		sent = make(chan struct{})
+		reply += " " + testHandoff(sent)
+	}
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				fmt.Fprint(c, reply)
+				c.Close()
+			}
+		}(ln)
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	<-ch
+	if sent != nil {
+		// the old generation is stopped after the handoff of its state
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// serveTestWorker serves the test worker with the options in background
+func serveTestWorker(t *testing.T, g *Graceful, opts ...OptionFunc) <-chan error {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]OptionFunc{
+		WithEnv(append(os.Environ(), envTestWorker+"=1")...),
+		WithStopOldDelay(0),
+		WithTimeout(5*time.Second, 5*time.Second, 5*time.Second),
+	}, opts...)
+	done := make(chan error, 1)
+	go func() { done <- g.Serve(exe, opts...) }()
+	return done
+}
+
+// shutdownTestWorker shuts down the Serve by the shutdown signal
+func shutdownTestWorker(t *testing.T, done <-chan error) {
+	t.Helper()
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		p.Signal(syscall.SIGTERM)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve returns %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve does not return after the shutdown signal")
+	}
+}
+
+// workerPid returns the pid of the worker that accepts on the addr
+func workerPid(t *testing.T, network, addr string) int {
+	t.Helper()
+	pid, _ := workerReply(t, network, addr)
+	return pid
+}
+
+// workerReply returns the pid and the rest of the reply of the worker that accepts on the addr
+func workerReply(t *testing.T, network, addr string) (int, string) {
+	t.Helper()
+	c, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("failed to read the pid from %s: %v", addr, err)
+	}
+	s := strings.SplitN(string(b), " ", 2)
+	pid, err := strconv.Atoi(s[0])
+	if err != nil {
+		t.Fatalf("invalid pid %q from %s", b, addr)
+	}
+	if len(s) < 2 {
+		return pid, ""
+	}
+	return pid, s[1]
+}
+
+func listenTCP(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+func TestGraceful_AddRemoveListener(t *testing.T) {
+	ln1, ln2, ln3 := listenTCP(t), listenTCP(t), listenTCP(t)
+	defer ln1.Close()
+	defer ln2.Close()
+	defer ln3.Close()
+
+	var fail int32
+	waitReady := func(_ context.Context, _ []net.Conn) error {
+		if atomic.LoadInt32(&fail) != 0 {
+			return errors.New("not ready")
+		}
+		return nil
+	}
+	g := NewGraceful()
+	done := serveTestWorker(t, g, WithListeners(ln1), WithWaitReadyFunc(waitReady), WithAutoRestartEnabled(true))
+	pid1 := workerPid(t, "tcp", ln1.Addr().String())
+
+	if err := g.AddListener(ln2); err != nil {
+		t.Fatal(err)
+	}
+	pid2 := workerPid(t, "tcp", ln2.Addr().String())
+	if pid2 == pid1 {
+		t.Errorf("pid got %d, want the new worker", pid2)
+	}
+	if pid := workerPid(t, "tcp", ln1.Addr().String()); pid != pid2 {
+		t.Errorf("pid of the first listener got %d, want %d", pid, pid2)
+	}
+
+	// the listener is not added if the new worker fails to start
+	atomic.StoreInt32(&fail, 1)
+	if err := g.AddListener(ln3); err == nil {
+		t.Fatal("AddListener succeeds, want the error of the restart")
+	}
+	atomic.StoreInt32(&fail, 0)
+	if err := g.RemoveListener(ln3); err == nil {
+		t.Error("RemoveListener of the listener that failed to be added succeeds")
+	}
+	if pid := workerPid(t, "tcp", ln2.Addr().String()); pid != pid2 {
+		t.Errorf("pid got %d, want the old worker %d", pid, pid2)
+	}
+
+	// the old worker is auto restarted with the files of its generation
+	p, err := os.FindProcess(pid2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	pid3 := workerPid(t, "tcp", ln2.Addr().String())
+	if pid3 == pid2 {
+		t.Errorf("pid got %d, want the auto restarted worker", pid3)
+	}
+	if pid := workerPid(t, "tcp", ln1.Addr().String()); pid != pid3 {
+		t.Errorf("pid of the first listener got %d, want %d", pid, pid3)
+	}
+
+	if err := g.RemoveListener(ln1); err != nil {
+		t.Fatal(err)
+	}
+	pid4 := workerPid(t, "tcp", ln2.Addr().String())
+	if pid4 == pid3 {
+		t.Errorf("pid got %d, want the new worker", pid4)
+	}
+	shutdownTestWorker(t, done)
+}
+
+func TestGraceful_ServeInListenFDsTrampoline(t *testing.T) {
+	defer saveEnv(envListenFDsExec)()
+	os.Setenv(envListenFDsExec, "1")
+	ln := listenTCP(t)
+	defer ln.Close()
+
+	// the embedding program forgot to call RunListenFDsTrampoline, so Serve must not start the worker
+	g := NewGraceful()
+	done := serveTestWorker(t, g, WithListeners(ln))
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "RunListenFDsTrampoline") {
+			t.Errorf("Serve returns %v, want the error of the trampoline", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve does not fail fast in the trampoline process")
+	}
+}
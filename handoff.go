@@ -0,0 +1,225 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kei2100/go-graceful/supervisor"
+)
+
+// ErrNoHandoff is returned when the handoff socket is not passed by the supervisor process.
+// e.g. the first worker generation, or WithHandoffEnabled is not set.
+var ErrNoHandoff = errors.New("graceful: no handoff")
+
+// Handoff is the channel from the old worker generation to the new one.
+// the old worker writes the serialized state and the new worker reads it.
+// files can be passed with SendFiles and ReceiveFiles, in the same order on both sides.
+// the reader of the state must not read ahead, e.g. encoding/gob does not since Handoff is an io.ByteReader.
+type Handoff struct {
+	conn *net.UnixConn
+}
+
+// Read reads the state from the old worker generation
+func (h *Handoff) Read(b []byte) (int, error) {
+	return h.conn.Read(b)
+}
+
+// ReadByte reads a byte of the state from the old worker generation
+func (h *Handoff) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(h.conn, b); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Write writes the state to the new worker generation
+func (h *Handoff) Write(b []byte) (int, error) {
+	return h.conn.Write(b)
+}
+
+// Close closes the handoff. the other side reads io.EOF
+func (h *Handoff) Close() error {
+	return h.conn.Close()
+}
+
+// SetDeadline sets the read and write deadlines
+func (h *Handoff) SetDeadline(t time.Time) error {
+	return h.conn.SetDeadline(t)
+}
+
+// SendFiles sends the files to the new worker generation with SCM_RIGHTS.
+// the files are duplicated in the new worker, so the caller still owns them.
+func (h *Handoff) SendFiles(files ...*os.File) error {
+	return sendFiles(h.conn, files)
+}
+
+// ReceiveFiles receives the files sent by SendFiles of the old worker generation
+func (h *Handoff) ReceiveFiles() ([]*os.File, error) {
+	return receiveFiles(h.conn, maxHandoffFiles)
+}
+
+// maxHandoffFiles is the maximum number of files sent by a SendFiles
+const maxHandoffFiles = 255
+
+// HandoffReceiver returns the handoff from the old worker generation.
+// returns ErrNoHandoff if this worker is not started by a restart.
+// this func only for worker process
+func HandoffReceiver() (*Handoff, error) {
+	handoffReceiver.once.Do(func() {
+		var conn *net.UnixConn
+		conn, handoffReceiver.err = envUnixConn(supervisor.EnvHandoffFD)
+		if conn != nil {
+			handoffReceiver.h = &Handoff{conn: conn}
+		}
+	})
+	return handoffReceiver.h, handoffReceiver.err
+}
+
+var handoffReceiver struct {
+	once sync.Once
+	h    *Handoff
+	err  error
+}
+
+// HandoffSender waits until the supervisor process starts the new worker generation,
+// and returns the handoff to it. the old worker is stopped after the StopOldDelay,
+// so the state should be sent soon.
+// returns ErrNoHandoff if the handoff is not enabled by the supervisor process,
+// or the worker is stopped without the new worker generation.
+// this func only for worker process
+func HandoffSender(ctx context.Context) (*Handoff, error) {
+	if err := startControl(); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-control.received:
+	}
+	if control.err != nil {
+		return nil, control.err
+	}
+	return &Handoff{conn: control.handoff}, nil
+}
+
+// connHandoffSender returns the socket to hand off the connections to the new worker generation.
+// the supervisor process sends the handoff sockets or the shutdown message before it stops the worker,
+// so it waits for them up to handoffWaitTimeout, in case the worker is stopped by another process.
+// returns ErrNoHandoff if the worker is stopped without the new worker generation.
+func connHandoffSender() (*net.UnixConn, error) {
+	if err := startControl(); err != nil {
+		return nil, err
+	}
+	select {
+	case <-control.received:
+	case <-time.After(handoffWaitTimeout):
+		return nil, ErrNoHandoff
+	}
+	if control.err != nil {
+		return nil, control.err
+	}
+	return control.connHandoff, nil
+}
+
+// handoffWaitTimeout is the timeout of waiting for the message from the supervisor process on stop
+const handoffWaitTimeout = time.Second
+
+// startControl starts receiving the handoff sockets from the control socket connected to the supervisor process
+func startControl() error {
+	control.once.Do(func() {
+		conn, err := envUnixConn(supervisor.EnvControlFD)
+		if err != nil {
+			control.startErr = err
+			return
+		}
+		control.received = make(chan struct{})
+		go receiveHandoffs(conn)
+	})
+	return control.startErr
+}
+
+var control struct {
+	once     sync.Once
+	startErr error
+
+	// received is closed when the handoff sockets are received or the control socket is closed
+	received    chan struct{}
+	handoff     *net.UnixConn
+	connHandoff *net.UnixConn
+	err         error
+}
+
+// receiveHandoffs receives the handoff sockets to the new worker generation, or the shutdown message.
+// the control socket is closed after that, because the old worker is stopped soon.
+func receiveHandoffs(conn *net.UnixConn) {
+	defer close(control.received)
+	defer conn.Close()
+	for {
+		files, msg, err := receiveControl(conn)
+		if err != nil {
+			control.err = err
+			return
+		}
+		if msg == supervisor.ControlShutdown {
+			closeFiles(files)
+			control.err = ErrNoHandoff
+			return
+		}
+		if msg != supervisor.ControlHandoff || len(files) != 2 {
+			closeFiles(files)
+			continue
+		}
+		control.handoff, control.err = fileUnixConn(files[0])
+		if control.err != nil {
+			files[1].Close()
+			return
+		}
+		control.connHandoff, control.err = fileUnixConn(files[1])
+		return
+	}
+}
+
+// envUnixConn creates the unix socket conn from the fd of the env
+func envUnixConn(key string) (*net.UnixConn, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil, ErrNoHandoff
+	}
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: invalid %s %q", key, v)
+	}
+	f := os.NewFile(uintptr(fd), key)
+	if f == nil {
+		return nil, fmt.Errorf("graceful: failed to NewFile. fd %v", fd)
+	}
+	return fileUnixConn(f)
+}
+
+func fileUnixConn(f *os.File) (*net.UnixConn, error) {
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to create handoff conn: %v", err)
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("graceful: handoff is not a unix socket %T", c)
+	}
+	return uc, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
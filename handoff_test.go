@@ -0,0 +1,87 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testHandoff receives the state from the old worker generation, and sends its own state
+// to the new generation in background. the state is the pid of the sender and the content
+// of a pipe passed with SendFiles. returns the received state, or the error of it.
+// sent is closed when the state is sent.
+func testHandoff(sent chan<- struct{}) string {
+	go func() {
+		defer close(sent)
+		h, err := HandoffSender(context.Background())
+		if err != nil {
+			return
+		}
+		defer h.Close()
+		r, w, err := os.Pipe()
+		if err != nil {
+			return
+		}
+		defer r.Close()
+		fmt.Fprintf(w, "pipe-of-%d", os.Getpid())
+		w.Close()
+		fmt.Fprintf(h, "%d\n", os.Getpid())
+		h.SendFiles(r)
+	}()
+
+	h, err := HandoffReceiver()
+	if err != nil {
+		return err.Error()
+	}
+	defer h.Close()
+	// the state is read byte by byte, not to read ahead of the files
+	var line []byte
+	for {
+		b, err := h.ReadByte()
+		if err != nil {
+			return err.Error()
+		}
+		if b == '\n' {
+			break
+		}
+		line = append(line, b)
+	}
+	files, err := h.ReceiveFiles()
+	if err != nil {
+		return err.Error()
+	}
+	defer closeFiles(files)
+	b, err := ioutil.ReadAll(files[0])
+	if err != nil {
+		return err.Error()
+	}
+	return string(line) + " " + string(b)
+}
+
+func TestGraceful_Handoff(t *testing.T) {
+	ln := listenTCP(t)
+	defer ln.Close()
+
+	g := NewGraceful()
+	done := serveTestWorker(t, g, WithListeners(ln), WithHandoffEnabled(true),
+		WithEnv(append(os.Environ(), envTestWorker+"=1", envTestHandoff+"=1")...))
+	pid1, state := workerReply(t, "tcp", ln.Addr().String())
+	if state != ErrNoHandoff.Error() {
+		t.Errorf("state of the first generation got %q, want %q", state, ErrNoHandoff.Error())
+	}
+
+	if err := g.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	pid2, state := workerReply(t, "tcp", ln.Addr().String())
+	if pid2 == pid1 {
+		t.Fatalf("pid got %d, want the new worker", pid2)
+	}
+	// the state and the fd are sent by the old worker, before it is stopped
+	if want := fmt.Sprintf("%d pipe-of-%d", pid1, pid1); state != want {
+		t.Errorf("state got %q, want %q", state, want)
+	}
+	shutdownTestWorker(t, done)
+}
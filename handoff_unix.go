@@ -0,0 +1,84 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// sendFiles sends the files with SCM_RIGHTS.
+// one byte of the number of the files is written with the rights, and it is consumed by receiveFiles.
+func sendFiles(conn *net.UnixConn, files []*os.File) error {
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		fds = append(fds, int(f.Fd()))
+	}
+	if _, _, err := conn.WriteMsgUnix([]byte{byte(len(fds))}, syscall.UnixRights(fds...), nil); err != nil {
+		return fmt.Errorf("graceful: failed to send files: %v", err)
+	}
+	return nil
+}
+
+// receiveControl receives a message and files from the control socket
+func receiveControl(conn *net.UnixConn) ([]*os.File, byte, error) {
+	b := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4*2))
+	n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, 0, fmt.Errorf("graceful: failed to receive from the supervisor: %v", err)
+	}
+	if n == 0 {
+		return nil, 0, fmt.Errorf("graceful: the control socket is closed")
+	}
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, 0, err
+	}
+	return files, b[0], nil
+}
+
+func receiveFiles(conn *net.UnixConn, max int) ([]*os.File, error) {
+	b := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4*max))
+	n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to receive files: %v", err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("graceful: failed to receive files: %v", io.EOF)
+	}
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != int(b[0]) {
+		closeFiles(files)
+		return nil, fmt.Errorf("graceful: received %d files, want %d", len(files), b[0])
+	}
+	return files, nil
+}
+
+func parseRights(oob []byte) ([]*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to parse socket control message: %v", err)
+	}
+	files := make([]*os.File, 0)
+	for _, m := range msgs {
+		fds, err := syscall.ParseUnixRights(&m)
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("graceful: failed to parse unix rights: %v", err)
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "handoff"))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,26 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+)
+
+// errPassFilesNotSupported is returned when the files are passed over the unix socket on this platform
+var errPassFilesNotSupported = fmt.Errorf("graceful: passing files over the unix socket is not supported on %s", runtime.GOOS)
+
+func sendFiles(conn *net.UnixConn, files []*os.File) error {
+	return errPassFilesNotSupported
+}
+
+func receiveControl(conn *net.UnixConn) ([]*os.File, byte, error) {
+	return nil, 0, errPassFilesNotSupported
+}
+
+func receiveFiles(conn *net.UnixConn, max int) ([]*os.File, error) {
+	return nil, errPassFilesNotSupported
+}
@@ -0,0 +1,68 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ListenConfig contains the socket options of the listeners and the packet conns created by the supervisor process.
+// the options are set before the sockets are shared with the worker processes.
+// the zero value is same as net.Listen and net.ListenPacket.
+type ListenConfig struct {
+	// Backlog is the maximum length of the accept queue. 0 uses the system default
+	Backlog int
+	// KeepAlive is the TCP keep-alive period of the connections accepted from the listening socket.
+	// 0 leaves it unchanged and negative disables the keep-alive.
+	// note that the Go runtime of the worker may set its own period to the accepted connections.
+	KeepAlive time.Duration
+	// DeferAccept sets TCP_DEFER_ACCEPT, the connection is not accepted until the data arrives or the timeout. linux only
+	DeferAccept time.Duration
+	// FastOpen sets TCP_FASTOPEN with the length of the queue. linux only
+	FastOpen int
+	// V6Only sets IPV6_V6ONLY, so that the socket bound to the IPv6 addr does not handle IPv4
+	V6Only bool
+	// FreeBind sets IP_FREEBIND to bind the addr that is not assigned to the host yet. linux only
+	FreeBind bool
+	// BindToDevice sets SO_BINDTODEVICE to handle the packets only from the device. linux only
+	BindToDevice string
+}
+
+// Listen creates a listener with the socket options.
+// the tcp options are ignored for the unix domain socket.
+// this func only for supervisor process
+func (lc ListenConfig) Listen(network, addr string) (net.Listener, error) {
+	nlc := net.ListenConfig{Control: lc.control}
+	ln, err := nlc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to listen: %v", err)
+	}
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return ln, nil
+	}
+	if err := lc.setListenOptions(sc, isTCPNetwork(network)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// ListenPacket creates a packet conn with the socket options.
+// the options for the listening socket, such as Backlog, are ignored.
+// this func only for supervisor process
+func (lc ListenConfig) ListenPacket(network, addr string) (net.PacketConn, error) {
+	nlc := net.ListenConfig{Control: lc.control}
+	pc, err := nlc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to listen packet: %v", err)
+	}
+	return pc, nil
+}
+
+func isTCPNetwork(network string) bool {
+	return strings.HasPrefix(network, "tcp")
+}
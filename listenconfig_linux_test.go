@@ -0,0 +1,82 @@
+package graceful
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// getsockopt reads the int socket option of the listener
+func getsockopt(t *testing.T, ln net.Listener, level, opt int) int {
+	t.Helper()
+	rc, err := ln.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestListenConfig_Listen(t *testing.T) {
+	lc := ListenConfig{KeepAlive: 30 * time.Second, DeferAccept: 5 * time.Second}
+	ln, err := lc.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if v := getsockopt(t, ln, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 1 {
+		t.Errorf("SO_KEEPALIVE got %d, want 1", v)
+	}
+	if v := getsockopt(t, ln, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != 30 {
+		t.Errorf("TCP_KEEPIDLE got %d, want 30", v)
+	}
+	if v := getsockopt(t, ln, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); v != 30 {
+		t.Errorf("TCP_KEEPINTVL got %d, want 30", v)
+	}
+	// the kernel rounds up the timeout to the retransmission
+	if v := getsockopt(t, ln, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT); v < 5 {
+		t.Errorf("TCP_DEFER_ACCEPT got %d, want at least 5", v)
+	}
+
+	// the negative keep-alive disables it
+	ln2, err := ListenConfig{KeepAlive: -1}.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+	if v := getsockopt(t, ln2, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 0 {
+		t.Errorf("SO_KEEPALIVE got %d, want 0", v)
+	}
+	if v := getsockopt(t, ln2, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT); v != 0 {
+		t.Errorf("TCP_DEFER_ACCEPT got %d, want 0", v)
+	}
+}
+
+func TestListenConfig_Listen_V6Only(t *testing.T) {
+	// the dual stack socket of "tcp" handles IPv4 unless V6Only
+	for _, v6only := range []bool{true, false} {
+		ln, err := ListenConfig{V6Only: v6only}.Listen("tcp", "[::]:0")
+		if err != nil {
+			t.Skipf("IPv6 is not available: %v", err)
+		}
+		want := 0
+		if v6only {
+			want = 1
+		}
+		if v := getsockopt(t, ln, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY); v != want {
+			t.Errorf("V6Only %v: IPV6_V6ONLY got %d, want %d", v6only, v, want)
+		}
+		ln.Close()
+	}
+}
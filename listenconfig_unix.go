@@ -0,0 +1,108 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// control sets the options before the socket is bound
+func (lc ListenConfig) control(network, _ string, c syscall.RawConn) error {
+	if !isTCPNetwork(network) && !strings.HasPrefix(network, "udp") {
+		return nil
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = lc.setBindOptions(int(fd), network)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func (lc ListenConfig) setBindOptions(fd int, network string) error {
+	if lc.V6Only && strings.HasSuffix(network, "6") {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1); err != nil {
+			return fmt.Errorf("graceful: failed to set IPV6_V6ONLY: %v", err)
+		}
+	}
+	if lc.FreeBind {
+		if err := setFreeBind(fd); err != nil {
+			return err
+		}
+	}
+	if lc.BindToDevice != "" {
+		if err := bindToDevice(fd, lc.BindToDevice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setListenOptions sets the options after the socket is listening
+func (lc ListenConfig) setListenOptions(sc syscall.Conn, tcp bool) error {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("graceful: failed to get the raw conn: %v", err)
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = lc.setListenSockopts(int(fd), tcp)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func (lc ListenConfig) setListenSockopts(fd int, tcp bool) error {
+	if lc.Backlog > 0 {
+		// listen again to change the backlog of the listening socket
+		if err := syscall.Listen(fd, lc.Backlog); err != nil {
+			return fmt.Errorf("graceful: failed to set the backlog: %v", err)
+		}
+	}
+	if !tcp {
+		return nil
+	}
+	if lc.KeepAlive != 0 {
+		if err := setKeepAlive(fd, lc.KeepAlive); err != nil {
+			return err
+		}
+	}
+	if lc.DeferAccept > 0 {
+		if err := setDeferAccept(fd, lc.DeferAccept); err != nil {
+			return err
+		}
+	}
+	if lc.FastOpen > 0 {
+		if err := setFastOpen(fd, lc.FastOpen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setKeepAlive sets the keep-alive to the listening socket, the accepted connections inherit it
+func setKeepAlive(fd int, period time.Duration) error {
+	if period < 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0); err != nil {
+			return fmt.Errorf("graceful: failed to set SO_KEEPALIVE: %v", err)
+		}
+		return nil
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+		return fmt.Errorf("graceful: failed to set SO_KEEPALIVE: %v", err)
+	}
+	return setKeepAlivePeriod(fd, period)
+}
+
+// roundSeconds rounds up the duration to the seconds for the socket options
+func roundSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
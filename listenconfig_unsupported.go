@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// control fails if any option is set, since the socket options are not supported on this platform
+func (lc ListenConfig) control(_, _ string, _ syscall.RawConn) error {
+	if lc != (ListenConfig{}) {
+		return fmt.Errorf("graceful: the socket options are not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
+
+// setListenOptions does nothing, the options are rejected by control
+func (lc ListenConfig) setListenOptions(_ syscall.Conn, _ bool) error {
+	return nil
+}
@@ -1,35 +1,197 @@
 package graceful
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// ErrNoSupervisor is returned when the process is not started by a supervisor process
+var ErrNoSupervisor = errors.New("graceful: not started by a supervisor")
+
 const envKey = "GRACEFUL_LISTENERS"
+
+// envFDsKey is the env key of the fds of GRACEFUL_LISTENERS, if they do not start from 3
+const envFDsKey = "GRACEFUL_LISTENERS_FDS"
 const envSep = ";"
 
+// nameSep separates the optional name and the rest in the env entry
+const nameSep = "="
+
+// networkSep separates the network type and the address in the env entry
+const networkSep = ":"
+
+// inheritedEntry represents an entry of GRACEFUL_LISTENERS
+type inheritedEntry struct {
+	name    string
+	network string
+	addr    string
+	fd      uintptr
+
+	// reusePort indicates that the worker binds the addr by itself with SO_REUSEPORT, instead of the fd
+	reusePort bool
+}
+
+// String encodes the entry.
+// e.g. tcp:127.0.0.1:8080, unix:%2Ftmp%2Fapp.sock, admin=tcp:127.0.0.1:9000
+// the name and the addr are escaped so that they can contain the separators.
+func (e inheritedEntry) String() string {
+	s := e.network + networkSep + escapeAddr(e.addr)
+	if e.name != "" {
+		s = url.QueryEscape(e.name) + nameSep + s
+	}
+	return s
+}
+
+// escapeAddr escapes the addr of the entry.
+// url.PathEscape leaves the nameSep, which is escaped additionally
+// so that the entry without the name is not split by the nameSep in the addr.
+func escapeAddr(addr string) string {
+	return strings.Replace(url.PathEscape(addr), nameSep, "%3D", -1)
+}
+
+// parseInheritedEntry decodes the entry.
+// the entry without a known network type is treated as a tcp address for compatibility.
+func parseInheritedEntry(s string) (inheritedEntry, error) {
+	var name string
+	if i := strings.Index(s, nameSep); i >= 0 {
+		n, err := url.QueryUnescape(s[:i])
+		if err != nil {
+			return inheritedEntry{}, fmt.Errorf("graceful: failed to unescape the inherited name %s: %v", s, err)
+		}
+		name, s = n, s[i+len(nameSep):]
+	}
+	i := strings.Index(s, networkSep)
+	if i < 0 || !isKnownNetwork(s[:i]) {
+		return inheritedEntry{name: name, network: "tcp", addr: s}, nil
+	}
+	addr, err := url.PathUnescape(s[i+len(networkSep):])
+	if err != nil {
+		return inheritedEntry{}, fmt.Errorf("graceful: failed to unescape the inherited addr %s: %v", s, err)
+	}
+	return inheritedEntry{name: name, network: s[:i], addr: addr}, nil
+}
+
+func isKnownNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix", "unixpacket":
+		return true
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+// IsSupervised reports whether this process is started by a supervisor process,
+// the graceful or the other supervisors of the env dialects.
+// this func only for worker process
+func IsSupervised() bool {
+	if _, ok := os.LookupEnv(envKey); ok {
+		return true
+	}
+	if _, ok := os.LookupEnv(envReusePortKey); ok {
+		return true
+	}
+	if _, ok := os.LookupEnv(envProxyKey); ok {
+		return true
+	}
+	return hasDialectEnv()
+}
+
+// inheritedEntries lists the entries of GRACEFUL_LISTENERS
+// followed by the entries of GRACEFUL_REUSEPORT_LISTENERS and GRACEFUL_PROXY_LISTENERS
+func inheritedEntries() ([]inheritedEntry, error) {
+	entries, err := fdEntries()
+	if err != nil {
+		return nil, err
+	}
+	rpEntries, err := reusePortEntries()
+	if err != nil {
+		return nil, err
+	}
+	pxEntries, err := proxyEntries()
+	if err != nil {
+		return nil, err
+	}
+	return append(append(entries, rpEntries...), pxEntries...), nil
+}
+
+// fdEntries lists the entries of GRACEFUL_LISTENERS.
+// the index of the entry corresponds to the fd 3+i, or the i-th fd of GRACEFUL_LISTENERS_FDS if it is set.
+// if GRACEFUL_LISTENERS is not set, the environment of the other supervisors are used.
+func fdEntries() ([]inheritedEntry, error) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return dialectEntries()
+	}
+	ss := strings.Split(v, envSep)
+	fds, err := listenerFDs(len(ss))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]inheritedEntry, 0, len(ss))
+	for i, s := range ss {
+		e, err := parseInheritedEntry(s)
+		if err != nil {
+			return nil, err
+		}
+		e.fd = fds[i]
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// listenerFDs returns the fds of the n entries of GRACEFUL_LISTENERS
+func listenerFDs(n int) ([]uintptr, error) {
+	fds := make([]uintptr, 0, n)
+	v := os.Getenv(envFDsKey)
+	if v == "" {
+		for i := 0; i < n; i++ {
+			fds = append(fds, uintptr(3+i)) // 0:stdin, 1:stdout, 2:stderr
+		}
+		return fds, nil
+	}
+	ss := strings.Split(v, envSep)
+	if len(ss) != n {
+		return nil, fmt.Errorf("graceful: %s has %d fds, want %d", envFDsKey, len(ss), n)
+	}
+	for _, s := range ss {
+		fd, err := strconv.Atoi(s)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("graceful: invalid %s %q", envFDsKey, v)
+		}
+		fds = append(fds, uintptr(fd))
+	}
+	return fds, nil
+}
+
 // InheritedListeners creates listeners from fd.
+// the named listeners are not included, use InheritedListener to get them.
+// returns ErrNoSupervisor if this process is not started by a supervisor process,
+// and *InheritedFDError if the fd does not match the entry advertised by the supervisor process.
 // this func only for worker process
 func InheritedListeners() ([]net.Listener, error) {
+	if !IsSupervised() {
+		return nil, ErrNoSupervisor
+	}
+	entries, err := inheritedEntries()
+	if err != nil {
+		return nil, err
+	}
 	lns := make([]net.Listener, 0)
-	for i, addr := range InheritedAddrs() {
-		ln, err := func() (net.Listener, error) {
-			fd := uintptr(3 + i) // 0:stdin, 1:stdout, 2:stderr
-			f := os.NewFile(fd, addr)
-			if f == nil {
-				return nil, fmt.Errorf("graceful: failed to NewFile. fd %v, addr %v", fd, addr)
-			}
-			defer f.Close()
-			ln, err := net.FileListener(f)
-			if err != nil {
-				return nil, fmt.Errorf("graceful: failed to create file listener: %v", err)
-			}
-			return ln, nil
-		}()
+	for _, e := range entries {
+		if e.name != "" || isPacketNetwork(e.network) {
+			continue
+		}
+		ln, err := inheritedListener(e)
 		if err != nil {
+			closeListeners(lns)
 			return nil, err
 		}
 		lns = append(lns, ln)
@@ -37,10 +199,39 @@ func InheritedListeners() ([]net.Listener, error) {
 	return lns, nil
 }
 
+// InheritedListener creates the listener named by the supervisor process.
+// returns ErrNoSupervisor if this process is not started by a supervisor process.
+// this func only for worker process
+func InheritedListener(name string) (net.Listener, error) {
+	if !IsSupervised() {
+		return nil, ErrNoSupervisor
+	}
+	entries, err := inheritedEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.name != name || isPacketNetwork(e.network) {
+			continue
+		}
+		return inheritedListener(e)
+	}
+	return nil, fmt.Errorf("graceful: listener %s is not inherited", name)
+}
+
 // InheritedAddrs lists inherited addrs from supervisor process.
 // this func only for worker process
 func InheritedAddrs() []string {
-	return strings.Split(os.Getenv(envKey), envSep)
+	entries, err := inheritedEntries()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	addrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		addrs = append(addrs, e.addr)
+	}
+	return addrs
 }
 
 // InheritOrListenTCP returns inherited listener.
@@ -50,63 +241,170 @@ func InheritOrListenTCP(addr string) (net.Listener, error) {
 	if err != nil {
 		return nil, fmt.Errorf("graceful: failed to resolve tcp addr %s: %v", addr, err)
 	}
-	addr = tcpAddr.String()
+	return inheritOrListen("tcp", tcpAddr.String())
+}
 
-	for i, iaddr := range InheritedAddrs() {
-		if iaddr != addr {
+// InheritOrListenUnix returns inherited unix domain socket listener.
+// if the path is not included inherited addrs, create a new listener.
+// the socket file of the inherited listener is not removed on close,
+// because the supervisor and the other workers still share it.
+func InheritOrListenUnix(path string) (net.Listener, error) {
+	return inheritOrListen("unix", path)
+}
+
+func inheritOrListen(network, addr string) (net.Listener, error) {
+	entries, err := inheritedEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !sameNetwork(e.network, network) || e.addr != addr {
 			continue
 		}
-		return func() (net.Listener, error) {
-			fd := uintptr(3 + i)
-			f := os.NewFile(fd, addr)
-			if f == nil {
-				return nil, fmt.Errorf("graceful: failed to NewFile. fd %v, addr %v", fd, addr)
-			}
-			defer f.Close()
-			ln, err := net.FileListener(f)
-			if err != nil {
-				return nil, fmt.Errorf("graceful: failed to create file listener: %v", err)
-			}
-			return ln, nil
-		}()
-	}
-	ln, err := net.Listen("tcp", addr)
+		return inheritedListener(e)
+	}
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("graceful: failed to listen: %v", err)
 	}
 	return ln, nil
 }
 
-// listenersEnv returns env var from listener addrs.
-// e.g. GRACEFUL_LISTENERS=127.0.0.1:8080;127.0.0.1:8081
+func sameNetwork(a, b string) bool {
+	return strings.TrimRight(a, "46") == strings.TrimRight(b, "46")
+}
+
+func inheritedListener(e inheritedEntry) (net.Listener, error) {
+	if e.reusePort {
+		return listenReusePort(e.network, e.addr)
+	}
+	if err := validateFD(e); err != nil {
+		return nil, err
+	}
+	f := os.NewFile(e.fd, e.addr)
+	if f == nil {
+		return nil, fmt.Errorf("graceful: failed to NewFile. fd %v, addr %v", e.fd, e.addr)
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to create file listener: %v", err)
+	}
+	if ln, ok := ln.(*net.UnixListener); ok {
+		ln.SetUnlinkOnClose(false)
+	}
+	return ln, nil
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		if err := ln.Close(); err != nil {
+			log.Printf("graceful: failed to close listener: %v", err)
+		}
+	}
+}
+
+// listenersEnv returns env vars from the entries.
+// e.g. GRACEFUL_LISTENERS=tcp:127.0.0.1:8080;unix:%2Ftmp%2Fapp.sock;admin=tcp:127.0.0.1:9000
+// GRACEFUL_LISTENERS_FDS is added if the fds do not start from 3,
+// and the env vars of the dialects follow them.
 // this func only for supervisor process
-func listenersEnv(listeners []net.Listener) string {
-	addrs := make([]string, 0)
-	for _, ln := range listeners {
-		addrs = append(addrs, ln.Addr().String())
+func listenersEnv(entries []inheritedEntry, dialects []EnvDialect) ([]string, error) {
+	ss := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ss = append(ss, e.String())
+	}
+	env := []string{fmt.Sprintf("%s=%s", envKey, strings.Join(ss, envSep))}
+	if len(entries) > 0 && entries[0].fd != 3 {
+		fds := make([]string, 0, len(entries))
+		for _, e := range entries {
+			fds = append(fds, strconv.Itoa(int(e.fd)))
+		}
+		env = append(env, fmt.Sprintf("%s=%s", envFDsKey, strings.Join(fds, envSep)))
+	}
+	for _, d := range dialects {
+		denv, err := dialectEnv(d, entries)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, denv...)
 	}
-	return fmt.Sprintf("%s=%s", envKey, strings.Join(addrs, envSep))
+	return env, nil
+}
+
+// createExtraFiles creates the extra files of the worker process and the corresponding entries.
+// the order is listeners, named listeners sorted by name, and packet conns.
+// this func only for supervisor process
+func createExtraFiles(o *option) ([]*os.File, []inheritedEntry, error) {
+	names := make([]string, 0, len(o.namedListeners))
+	for name := range o.namedListeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lns := make([]net.Listener, 0, len(o.listeners)+len(names))
+	entries := make([]inheritedEntry, 0, len(o.listeners)+len(names)+len(o.packetConns))
+	for _, ln := range o.listeners {
+		lns = append(lns, ln)
+		entries = append(entries, listenerEntry("", ln))
+	}
+	for _, name := range names {
+		ln := o.namedListeners[name]
+		lns = append(lns, ln)
+		entries = append(entries, listenerEntry(name, ln))
+	}
+	for _, pc := range o.packetConns {
+		entries = append(entries, packetConnEntry(pc))
+	}
+	for i := range entries {
+		entries[i].fd = uintptr(3 + i)
+	}
+
+	files, err := createListenerFiles(lns)
+	if err != nil {
+		return nil, nil, err
+	}
+	pcFiles, err := createPacketConnFiles(o.packetConns)
+	if err != nil {
+		closeListenerFiles(files)
+		return nil, nil, err
+	}
+	return append(files, pcFiles...), entries, nil
+}
+
+func listenerEntry(name string, ln net.Listener) inheritedEntry {
+	addr := ln.Addr()
+	return inheritedEntry{name: name, network: addr.Network(), addr: addr.String()}
 }
 
 func createListenerFiles(listeners []net.Listener) ([]*os.File, error) {
 	fs := make([]*os.File, 0)
 	for _, l := range listeners {
+		var f *os.File
+		var e error
 		switch l := l.(type) {
 		case *net.TCPListener:
-			f, e := l.File()
-			if e != nil {
-				closeListenerFiles(fs)
-				return nil, fmt.Errorf("graceful: failed to create listener file: %v", e)
-			}
-			fs = append(fs, f)
+			f, e = socketFile(l, socketFileName(l.Addr()))
+		case *net.UnixListener:
+			f, e = socketFile(l, socketFileName(l.Addr()))
 		default:
 			closeListenerFiles(fs)
 			return nil, fmt.Errorf("graceful: failed to create listener file. not implemented %T", l)
 		}
+		if e != nil {
+			closeListenerFiles(fs)
+			return nil, fmt.Errorf("graceful: failed to create listener file: %v", e)
+		}
+		fs = append(fs, f)
 	}
 	return fs, nil
 }
 
+// socketFileName returns the name of the file of the socket, like the File method of the socket
+func socketFileName(addr net.Addr) string {
+	return addr.Network() + ":" + addr.String()
+}
+
 func closeListenerFiles(files []*os.File) {
 	for _, f := range files {
 		if err := f.Close(); err != nil {
@@ -0,0 +1,62 @@
+package graceful
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInheritedEntry_RoundTrip(t *testing.T) {
+	tests := []inheritedEntry{
+		{network: "tcp", addr: "127.0.0.1:8080"},
+		{network: "tcp6", addr: "[::1]:8080"},
+		{network: "unix", addr: "/tmp/app.sock"},
+		{network: "unix", addr: "/run/a=b.sock"},
+		{network: "unix", addr: "/run/a;b.sock"},
+		{network: "unix", addr: "/run/a:b.sock"},
+		{network: "unix", addr: "/run/a%3Db.sock"},
+		{network: "unix", addr: "/run/a=b;c:d%e?f.sock"},
+		{network: "unixgram", addr: "@abstract=1"},
+		{name: "admin", network: "tcp", addr: "127.0.0.1:9000"},
+		{name: "a=b;c:d%e", network: "unix", addr: "/run/a=b;c:d%e.sock"},
+	}
+	ss := make([]string, 0, len(tests))
+	for _, e := range tests {
+		ss = append(ss, e.String())
+	}
+	// the entries are joined into an env value, then split by the worker
+	got := strings.Split(strings.Join(ss, envSep), envSep)
+	if len(got) != len(tests) {
+		t.Fatalf("split into %d entries, want %d: %v", len(got), len(tests), got)
+	}
+	for i, s := range got {
+		e, err := parseInheritedEntry(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if e != tests[i] {
+			t.Errorf("%s: got %+v, want %+v", s, e, tests[i])
+		}
+	}
+}
+
+func TestParseInheritedEntry_Compat(t *testing.T) {
+	tests := []struct {
+		in   string
+		want inheritedEntry
+	}{
+		{in: "127.0.0.1:8080", want: inheritedEntry{network: "tcp", addr: "127.0.0.1:8080"}},
+		{in: "[::1]:8080", want: inheritedEntry{network: "tcp", addr: "[::1]:8080"}},
+		{in: "localhost:8080", want: inheritedEntry{network: "tcp", addr: "localhost:8080"}},
+	}
+	for _, tt := range tests {
+		got, err := parseInheritedEntry(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package graceful
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// envListenFDsExec marks the process that is started to set LISTEN_PID and exec the worker command
+const envListenFDsExec = "GRACEFUL_LISTEN_FDS_EXEC"
+
+// RunListenFDsTrampoline execs the worker command in place with LISTEN_PID set to the pid of this process,
+// if this process is started by the supervisor with WithListenFDsEnvEnabled. otherwise it returns immediately.
+// the LISTEN_PID must be the pid of the worker process, which is not known before the fork,
+// so the supervisor starts its own executable, which must call this func at the beginning of the main.
+// this func only for supervisor executable
+func RunListenFDsTrampoline() {
+	if os.Getenv(envListenFDsExec) == "" {
+		return
+	}
+	os.Unsetenv(envListenFDsExec)
+	if len(os.Args) < 3 {
+		fmt.Fprintf(os.Stderr, "graceful: invalid arguments to exec the worker %v\n", os.Args)
+		os.Exit(1)
+	}
+	os.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+	// os.Args: [self, path of the worker command, worker command, worker args...]
+	if err := syscall.Exec(os.Args[1], os.Args[2:], os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "graceful: failed to exec the worker %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// listenFDsCommand returns the command, args and env to start the worker
+// with LISTEN_FDS, LISTEN_FDNAMES and LISTEN_PID of systemd socket activation.
+// the worker is started via RunListenFDsTrampoline of the executable of this process.
+// this func only for supervisor process
+func listenFDsCommand(command string, args []string, env []string, entries []inheritedEntry) (string, []string, []string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("graceful: failed to get the executable: %v", err)
+	}
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("graceful: failed to find the command %s: %v", command, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if strings.Contains(e.name, ":") {
+			return "", nil, nil, fmt.Errorf("graceful: the name %s can not be used in %s", e.name, envListenFDNames)
+		}
+		name := e.name
+		if name == "" {
+			name = "unknown"
+		}
+		names = append(names, name)
+	}
+
+	newEnv := make([]string, 0, len(env)+3)
+	for _, kv := range env {
+		if isListenFDsEnv(kv) {
+			continue
+		}
+		newEnv = append(newEnv, kv)
+	}
+	newEnv = append(newEnv,
+		fmt.Sprintf("%s=%d", envListenFDs, len(entries)),
+		fmt.Sprintf("%s=%s", envListenFDNames, strings.Join(names, ":")),
+		envListenFDsExec+"=1",
+	)
+	return self, append([]string{path, command}, args...), newEnv, nil
+}
+
+func isListenFDsEnv(kv string) bool {
+	for _, k := range []string{envListenPID, envListenFDs, envListenFDNames, envListenFDsExec} {
+		if strings.HasPrefix(kv, k+"=") {
+			return true
+		}
+	}
+	return false
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"syscall"
 	"time"
+
+	"github.com/kei2100/go-graceful/worker"
 )
 
 // options
@@ -13,11 +15,35 @@ type option struct {
 	args               []string
 	env                []string
 	listeners          []net.Listener
+	namedListeners     map[string]net.Listener
+	packetConns        []net.PacketConn
 	waitReadyFunc      func(ctx context.Context, extraFileConns []net.Conn) error
 	autoRestartEnabled bool
+	restartPolicy      worker.RestartPolicy
+
+	listenFDsEnvEnabled bool
+	envDialects         []EnvDialect
+	tlsCertFile         string
+	tlsKeyFile          string
+
+	files          map[string]*os.File
+	handoffEnabled bool
+	credential     *worker.Credential
+
+	subreaperEnabled bool
+
+	takeoverSocket string
+	takeover       *Takeover
+
+	proxyNetwork string
+
+	reusePortAddrs      []net.Addr
+	namedReusePortAddrs map[string]net.Addr
 
 	restartSignals     []os.Signal
 	shutdownSignals    []os.Signal
+	upgradeSignals     []os.Signal
+	forwardSignals     []os.Signal
 	gracefulStopSignal os.Signal
 
 	startTimeout    time.Duration
@@ -88,6 +114,144 @@ func WithListeners(listeners ...net.Listener) OptionFunc {
 	return func(o *option) { o.listeners = listeners }
 }
 
+// WithNamedListeners set named listeners.
+// the worker process gets them by name with InheritedListener,
+// so adding a listener does not shift the others.
+func WithNamedListeners(listeners map[string]net.Listener) OptionFunc {
+	return func(o *option) { o.namedListeners = listeners }
+}
+
+// WithPacketConns set packet conns such as *net.UDPConn.
+// packet conns are copied to os.File and set to extra files of worker process,
+// following the listeners.
+func WithPacketConns(packetConns ...net.PacketConn) OptionFunc {
+	return func(o *option) { o.packetConns = packetConns }
+}
+
+// WithListenFDsEnvEnabled set listenFDsEnvEnabled.
+// if enabled, LISTEN_FDS, LISTEN_FDNAMES and LISTEN_PID of systemd socket activation
+// are also set to the worker processes, in addition to GRACEFUL_LISTENERS.
+// the worker process is started through the executable of the supervisor process to set LISTEN_PID,
+// so the main of the executable must call RunListenFDsTrampoline first, otherwise Serve of the started process fails.
+func WithListenFDsEnvEnabled(enabled bool) OptionFunc {
+	return func(o *option) { o.listenFDsEnvEnabled = enabled }
+}
+
+// WithEnvDialects set envDialects.
+// the env vars of the dialects are also set to the worker processes, in addition to GRACEFUL_LISTENERS,
+// so that the workers written for the other supervisors run unmodified.
+// EnvDialectTableflip also passes the pipes of tableflip at the fds 3 and 4, so the extra files start from 5.
+func WithEnvDialects(dialects ...EnvDialect) OptionFunc {
+	return func(o *option) { o.envDialects = dialects }
+}
+
+// WithTLSFiles set the certificate file and the key file for the worker processes.
+// the worker gets them with InheritOrListenTLS.
+func WithTLSFiles(certFile, keyFile string) OptionFunc {
+	return func(o *option) {
+		o.tlsCertFile = certFile
+		o.tlsKeyFile = keyFile
+	}
+}
+
+// WithReusePortAddrs set addrs that each worker generation binds by itself with SO_REUSEPORT,
+// instead of inheriting the listeners of the supervisor process.
+// the kernel distributes the connections to each worker, and the old worker is stopped
+// after the new worker has bound all the addrs.
+// the worker gets them with InheritedListeners, InheritedPacketConns or InheritOrListenTCP.
+func WithReusePortAddrs(addrs ...net.Addr) OptionFunc {
+	return func(o *option) { o.reusePortAddrs = addrs }
+}
+
+// WithNamedReusePortAddrs set named addrs that each worker generation binds by itself with SO_REUSEPORT.
+// the worker gets them with InheritedListener.
+func WithNamedReusePortAddrs(addrs map[string]net.Addr) OptionFunc {
+	return func(o *option) { o.namedReusePortAddrs = addrs }
+}
+
+// WithFiles adds the named file passed to the worker processes, such as a lock file or a log file.
+// the file is duplicated for each worker generation, so the caller still owns it.
+// the worker gets it with InheritedFile.
+func WithFiles(name string, file *os.File) OptionFunc {
+	return func(o *option) {
+		if o.files == nil {
+			o.files = make(map[string]*os.File)
+		}
+		o.files[name] = file
+	}
+}
+
+// WithHandoffEnabled set handoffEnabled.
+// if enabled, the old worker generation can hand off its state to the new one on restart,
+// with HandoffSender and HandoffReceiver, and the idle connections with ConnHandoffListener.
+func WithHandoffEnabled(enabled bool) OptionFunc {
+	return func(o *option) { o.handoffEnabled = enabled }
+}
+
+// WithCredential set the uid, the gid and the supplementary groups of the worker processes.
+// the supervisor process binds the listeners with its privileges, e.g. root for :443,
+// and the workers run as the credential. the workers fail to start if the credential can not be set.
+// the listeners are inherited as the fds, which are not checked against the credential,
+// but InheritedListeners of the worker verifies each fd with getsockname.
+// note that the unix domain socket files are still owned by the supervisor process.
+// unix only, the workers fail to start on the other platforms.
+func WithCredential(cred *worker.Credential) OptionFunc {
+	return func(o *option) { o.credential = cred }
+}
+
+// WithSubreaperEnabled set subreaperEnabled.
+// if enabled, the orphaned descendants of the workers, e.g. daemonized ones, are reparented to
+// the supervisor process instead of init. they are reaped, and terminated with the worker that spawned them.
+// note that all the children of the supervisor process other than the workers are reaped,
+// so the supervisor process must not start the other processes that it waits for by itself, e.g. by os/exec.
+// linux only. see worker.EnableSubreaper
+func WithSubreaperEnabled(enabled bool) OptionFunc {
+	return func(o *option) { o.subreaperEnabled = enabled }
+}
+
+// WithUpgradeSignals set the signals to upgrade the supervisor process. see Upgrade
+func WithUpgradeSignals(sigs ...os.Signal) OptionFunc {
+	return func(o *option) { o.upgradeSignals = sigs }
+}
+
+// WithForwardSignals set the signals that are forwarded to the current worker process and its process group as they are.
+// the signals to restart, shutdown and upgrade are not forwarded even if they are set
+func WithForwardSignals(sigs ...os.Signal) OptionFunc {
+	return func(o *option) { o.forwardSignals = sigs }
+}
+
+// WithTakeoverSocket set the path of the unix domain socket, where the other supervisor process
+// takes over the listeners with TakeoverListeners.
+// after the worker of the other supervisor process is started, this supervisor process stops its worker
+// with the gracefulStopSignal and Serve returns.
+func WithTakeoverSocket(path string) OptionFunc {
+	return func(o *option) { o.takeoverSocket = path }
+}
+
+// WithTakeover set the takeover from the running supervisor process.
+// the running supervisor process is drained after the first worker is started.
+// the takeover socket of this supervisor process starts listening after that.
+func WithTakeover(t *Takeover) OptionFunc {
+	return func(o *option) { o.takeover = t }
+}
+
+// WithProxy set the network of the proxy mode, tcp, unix or http. empty disables the proxy mode.
+// in the proxy mode, the supervisor process accepts on the listeners by itself,
+// and proxies the connections to the private addrs that each worker binds.
+// the addrs are passed by GRACEFUL_PROXY_LISTENERS, and PORT for the first listener if tcp or http.
+// PORT is only for the first listener, so the worker of multiple listeners must use GRACEFUL_PROXY_LISTENERS,
+// e.g. InheritedListeners binds them.
+// the connections accepted before the first worker is ready wait for it up to the start timeout.
+// the new connections are proxied to the new worker after WaitReadyFunc succeeds,
+// and the existing connections are kept on the old worker until they are closed.
+// in the http mode, the requests are reverse proxied to the new worker even on the existing connections,
+// and the old worker is stopped as soon as its in-flight requests are done, instead of stopOldDelay.
+// the in-flight counts are reported by Graceful.InFlight.
+// the packet conns are not supported.
+func WithProxy(network string) OptionFunc {
+	return func(o *option) { o.proxyNetwork = network }
+}
+
 // WithWaitReadyFunc set WaitReadyFunc
 func WithWaitReadyFunc(waitReadyFunc func(context.Context, []net.Conn) error) OptionFunc {
 	return func(o *option) { o.waitReadyFunc = waitReadyFunc }
@@ -100,6 +264,12 @@ func WithAutoRestartEnabled(autoRestartEnabled bool) OptionFunc {
 	}
 }
 
+// WithAutoRestartPolicy set the backoff and the crash loop detection of the auto restart.
+// Serve returns worker.CrashLoopError when the worker is in the crash loop.
+func WithAutoRestartPolicy(policy worker.RestartPolicy) OptionFunc {
+	return func(o *option) { o.restartPolicy = policy }
+}
+
 // WithTimeout set timeout setting
 func WithTimeout(startTimeout, shutdownTimeout, restartTimeout time.Duration) OptionFunc {
 	return func(o *option) {
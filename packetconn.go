@@ -0,0 +1,129 @@
+package graceful
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// InheritedPacketConns creates packet conns from fd.
+// returns ErrNoSupervisor if this process is not started by a supervisor process,
+// and *InheritedFDError if the fd does not match the entry advertised by the supervisor process.
+// this func only for worker process
+func InheritedPacketConns() ([]net.PacketConn, error) {
+	if !IsSupervised() {
+		return nil, ErrNoSupervisor
+	}
+	entries, err := inheritedEntries()
+	if err != nil {
+		return nil, err
+	}
+	pcs := make([]net.PacketConn, 0)
+	for _, e := range entries {
+		if e.name != "" || !isPacketNetwork(e.network) {
+			continue
+		}
+		pc, err := inheritedPacketConn(e)
+		if err != nil {
+			closePacketConns(pcs)
+			return nil, err
+		}
+		pcs = append(pcs, pc)
+	}
+	return pcs, nil
+}
+
+// InheritOrListenUDP returns inherited udp packet conn.
+// if the addr is not included inherited addrs, create a new packet conn
+func InheritOrListenUDP(addr string) (net.PacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to resolve udp addr %s: %v", addr, err)
+	}
+	return inheritOrListenPacket("udp", udpAddr.String())
+}
+
+// InheritOrListenUnixgram returns inherited unixgram packet conn.
+// if the path is not included inherited addrs, create a new packet conn
+func InheritOrListenUnixgram(path string) (net.PacketConn, error) {
+	return inheritOrListenPacket("unixgram", path)
+}
+
+func inheritOrListenPacket(network, addr string) (net.PacketConn, error) {
+	entries, err := inheritedEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !sameNetwork(e.network, network) || e.addr != addr {
+			continue
+		}
+		return inheritedPacketConn(e)
+	}
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to listen packet: %v", err)
+	}
+	return pc, nil
+}
+
+func isPacketNetwork(network string) bool {
+	return strings.HasPrefix(network, "udp") || network == "unixgram"
+}
+
+func inheritedPacketConn(e inheritedEntry) (net.PacketConn, error) {
+	if e.reusePort {
+		return listenPacketReusePort(e.network, e.addr)
+	}
+	if err := validateFD(e); err != nil {
+		return nil, err
+	}
+	f := os.NewFile(e.fd, e.addr)
+	if f == nil {
+		return nil, fmt.Errorf("graceful: failed to NewFile. fd %v, addr %v", e.fd, e.addr)
+	}
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to create file packet conn: %v", err)
+	}
+	return pc, nil
+}
+
+func closePacketConns(pcs []net.PacketConn) {
+	for _, pc := range pcs {
+		if err := pc.Close(); err != nil {
+			log.Printf("graceful: failed to close packet conn: %v", err)
+		}
+	}
+}
+
+func packetConnEntry(pc net.PacketConn) inheritedEntry {
+	addr := pc.LocalAddr()
+	return inheritedEntry{network: addr.Network(), addr: addr.String()}
+}
+
+func createPacketConnFiles(packetConns []net.PacketConn) ([]*os.File, error) {
+	fs := make([]*os.File, 0)
+	for _, pc := range packetConns {
+		var f *os.File
+		var e error
+		switch pc := pc.(type) {
+		case *net.UDPConn:
+			f, e = socketFile(pc, socketFileName(pc.LocalAddr()))
+		case *net.UnixConn:
+			f, e = socketFile(pc, socketFileName(pc.LocalAddr()))
+		default:
+			closeListenerFiles(fs)
+			return nil, fmt.Errorf("graceful: failed to create packet conn file. not implemented %T", pc)
+		}
+		if e != nil {
+			closeListenerFiles(fs)
+			return nil, fmt.Errorf("graceful: failed to create packet conn file: %v", e)
+		}
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
@@ -0,0 +1,126 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package graceful
+
+import (
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// dupTestFD duplicates the fd of the file, that is owned by the caller instead of the file
+func dupTestFD(t *testing.T, f *os.File) uintptr {
+	t.Helper()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.CloseOnExec(fd)
+	return uintptr(fd)
+}
+
+// setWorkerEnv sets the env of the worker process for the option,
+// as the supervisor process passes the extra files to the worker.
+// the fds are dup'ed in this process instead of the fds starting from 3
+func setWorkerEnv(t *testing.T, o *option) []inheritedEntry {
+	t.Helper()
+	files, entries, err := createExtraFiles(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListenerFiles(files)
+	for i, f := range files {
+		entries[i].fd = dupTestFD(t, f)
+	}
+	env, err := listenersEnv(entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		os.Setenv(kv[:i], kv[i+1:])
+	}
+	return entries
+}
+
+// testPacketRoundTrip checks that the packet conn receives the datagram sent to the addr, and replies to it
+func testPacketRoundTrip(t *testing.T, pc net.PacketConn, addr string) {
+	t.Helper()
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("received %q, want ping", buf[:n])
+	}
+	if _, err := pc.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err = c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Errorf("replied %q, want pong", buf[:n])
+	}
+}
+
+func TestInheritedPacketConns_RoundTrip(t *testing.T) {
+	defer saveEnv(supervisorEnvKeys...)()
+	for _, key := range supervisorEnvKeys {
+		os.Unsetenv(key)
+	}
+	ln := listenTCP(t)
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	addr := pc.LocalAddr().String()
+	o := &option{listeners: []net.Listener{ln}, packetConns: []net.PacketConn{pc}}
+
+	setWorkerEnv(t, o)
+	lns, err := InheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeListeners(lns)
+	pcs, err := InheritedPacketConns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closePacketConns(pcs)
+	if len(pcs) != 1 {
+		t.Fatalf("got %d packet conns, want 1", len(pcs))
+	}
+	if got := pcs[0].LocalAddr().String(); got != addr {
+		t.Errorf("addr got %s, want %s", got, addr)
+	}
+	testPacketRoundTrip(t, pcs[0], addr)
+
+	// InheritOrListenUDP returns the inherited conn of the addr instead of listening
+	entries := setWorkerEnv(t, o)
+	defer syscall.Close(int(entries[0].fd))
+	upc, err := InheritOrListenUDP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upc.Close()
+	testPacketRoundTrip(t, upc, addr)
+}
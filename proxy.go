@@ -0,0 +1,440 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// envProxyKey is the env key of the addrs that the worker binds by itself in the proxy mode.
+// the format of the entries is same as GRACEFUL_LISTENERS
+const envProxyKey = "GRACEFUL_PROXY_LISTENERS"
+
+// envPort is the env key of the port of the first listener in the tcp proxy mode.
+// the worker must bind the others with GRACEFUL_PROXY_LISTENERS
+const envPort = "PORT"
+
+// errProxyClosed is returned when the connection is not proxied since the proxy is closed
+var errProxyClosed = errors.New("graceful: the proxy is closed")
+
+// proxyReadyInterval is the interval to check that the new worker accepts on the backend addrs
+const proxyReadyInterval = 100 * time.Millisecond
+
+// proxyEntries lists the entries of GRACEFUL_PROXY_LISTENERS
+func proxyEntries() ([]inheritedEntry, error) {
+	return addrEntries(envProxyKey)
+}
+
+// proxy accepts on the listeners of the supervisor process,
+// and proxies the connections to the backend addrs of the current worker generation.
+// each worker generation binds its own backend addrs, passed by GRACEFUL_PROXY_LISTENERS and PORT.
+// in the http mode, the requests are reverse proxied instead of the connections,
+// so that the keep-alive clients move to the new generation request by request.
+type proxy struct {
+	network   string // the network of the backend addrs, tcp or unix
+	http      bool
+	listeners []net.Listener
+	names     []string
+	dir       string // the directory of the unix domain sockets
+	transport *http.Transport
+	// startTimeout is the timeout of waiting for the first generation to be ready. 0 waits without the timeout
+	startTimeout time.Duration
+	// shutdownTimeout is the timeout of shutting down the servers of the http mode. 0 waits without the timeout
+	shutdownTimeout time.Duration
+	servers         []*http.Server // the servers of the http mode
+	closed          chan struct{}  // closed when the proxy is closed
+
+	mu      sync.Mutex
+	gen     int
+	pending *proxyBackend // the backend of the starting generation
+	current *proxyBackend // the backend of the ready generation
+	old     *proxyBackend // the backend of the previous generation, until it is idle or the next generation is ready
+	ready   chan struct{} // closed when the first generation is ready
+}
+
+// proxyBackend represents the backend addrs of a worker generation
+type proxyBackend struct {
+	addrs []string
+
+	mu       sync.Mutex
+	inflight int           // the number of the in-flight requests, or the connections in the tcp mode
+	idle     chan struct{} // closed when the inflight becomes 0 while waiting
+}
+
+// newProxy creates the proxy of the listeners and the named listeners.
+// the network is tcp, unix or http.
+// this func only for supervisor process
+func newProxy(network string, o *option) (*proxy, error) {
+	p := &proxy{
+		network:         network,
+		startTimeout:    o.startTimeout,
+		shutdownTimeout: o.shutdownTimeout,
+		ready:           make(chan struct{}),
+		closed:          make(chan struct{}),
+	}
+	switch network {
+	case "tcp", "unix":
+	case "http":
+		p.network, p.http = "tcp", true
+		p.transport = &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	default:
+		return nil, fmt.Errorf("graceful: unsupported proxy network %s", network)
+	}
+	if len(o.packetConns) > 0 {
+		return nil, fmt.Errorf("graceful: packet conns can not be proxied")
+	}
+	for _, ln := range o.listeners {
+		p.listeners = append(p.listeners, ln)
+		p.names = append(p.names, "")
+	}
+	names := make([]string, 0, len(o.namedListeners))
+	for name := range o.namedListeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.listeners = append(p.listeners, o.namedListeners[name])
+		p.names = append(p.names, name)
+	}
+	if p.network == "unix" {
+		dir, err := ioutil.TempDir("", "graceful-proxy")
+		if err != nil {
+			return nil, fmt.Errorf("graceful: failed to create the directory of the proxy sockets: %v", err)
+		}
+		p.dir = dir
+		if o.credential != nil {
+			// the worker binds the sockets in the directory as the credential
+			if err := os.Chown(dir, int(o.credential.Uid), int(o.credential.Gid)); err != nil {
+				os.RemoveAll(dir)
+				return nil, fmt.Errorf("graceful: failed to chown the directory of the proxy sockets: %v", err)
+			}
+		}
+	}
+	return p, nil
+}
+
+// serve starts accepting on the listeners
+func (p *proxy) serve() {
+	for i, ln := range p.listeners {
+		if p.http {
+			srv := &http.Server{Handler: p.reverseProxy(i)}
+			p.servers = append(p.servers, srv)
+			go srv.Serve(ln)
+			continue
+		}
+		go p.acceptLoop(i, ln)
+	}
+}
+
+// close removes the directory of the unix domain sockets,
+// and the connections waiting for the first generation are closed.
+// the servers of the http mode are shut down, that closes the listeners.
+// the listeners of the tcp and unix mode are owned by the caller.
+func (p *proxy) close() {
+	close(p.closed)
+	if len(p.servers) > 0 {
+		ctx := context.Background()
+		if p.shutdownTimeout > 0 {
+			var can context.CancelFunc
+			ctx, can = context.WithTimeout(ctx, p.shutdownTimeout)
+			defer can()
+		}
+		for _, srv := range p.servers {
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("graceful: failed to shutdown the proxy server: %v", err)
+			}
+		}
+	}
+	if p.dir != "" {
+		os.RemoveAll(p.dir)
+	}
+	if p.transport != nil {
+		p.transport.CloseIdleConnections()
+	}
+}
+
+// generationEnv allocates the backend addrs of the next worker generation, and returns the env of them.
+// it is used as GenerationEnvFunc of the supervisor.
+func (p *proxy) generationEnv() ([]string, error) {
+	p.mu.Lock()
+	p.gen++
+	gen := p.gen
+	p.mu.Unlock()
+
+	addrs := make([]string, 0, len(p.listeners))
+	for i := range p.listeners {
+		addr, err := p.allocate(gen, i)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	p.mu.Lock()
+	p.pending = &proxyBackend{addrs: addrs}
+	p.mu.Unlock()
+
+	ss := make([]string, 0, len(addrs))
+	for i, addr := range addrs {
+		ss = append(ss, inheritedEntry{name: p.names[i], network: p.network, addr: addr}.String())
+	}
+	env := []string{fmt.Sprintf("%s=%s", envProxyKey, strings.Join(ss, envSep))}
+	if p.network == "tcp" && len(addrs) > 0 {
+		_, port, err := net.SplitHostPort(addrs[0])
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fmt.Sprintf("%s=%s", envPort, port))
+	}
+	return env, nil
+}
+
+// allocate allocates the backend addr of the i-th listener for the generation
+func (p *proxy) allocate(gen, i int) (string, error) {
+	if p.network == "unix" {
+		return filepath.Join(p.dir, strconv.Itoa(gen)+"-"+strconv.Itoa(i)+".sock"), nil
+	}
+	// the port may be taken by the others until the worker binds it, but it is unlikely
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("graceful: failed to allocate the proxy port: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// waitReadyFunc returns WaitReadyFunc that waits until the new worker accepts on the backend addrs,
+// then waitReadyFunc is called if not nil, and the new connections are proxied to the new worker.
+// this func only for supervisor process
+func (p *proxy) waitReadyFunc(waitReadyFunc func(context.Context, []net.Conn) error) func(context.Context, []net.Conn) error {
+	return func(ctx context.Context, conns []net.Conn) error {
+		p.mu.Lock()
+		pending := p.pending
+		p.mu.Unlock()
+		if err := p.waitAccepting(ctx, pending.addrs); err != nil {
+			return err
+		}
+		if waitReadyFunc != nil {
+			if err := waitReadyFunc(ctx, conns); err != nil {
+				return err
+			}
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.current == nil {
+			close(p.ready)
+		}
+		// the auto restarted worker keeps the backend of its generation
+		if p.current != pending {
+			p.old, p.current = p.current, pending
+		}
+		return nil
+	}
+}
+
+// waitIdle waits until the previous generation has no in-flight requests.
+// it is used as WaitIdleFunc of the supervisor in the http mode.
+func (p *proxy) waitIdle(ctx context.Context) error {
+	p.mu.Lock()
+	old := p.old
+	p.mu.Unlock()
+	if old == nil {
+		return nil
+	}
+	defer p.transport.CloseIdleConnections()
+	err := old.waitIdle(ctx)
+	p.mu.Lock()
+	if p.old == old {
+		p.old = nil
+	}
+	p.mu.Unlock()
+	return err
+}
+
+// inFlight returns the in-flight counts of the current and the previous generation
+func (p *proxy) inFlight() (current, old int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current.count(), p.old.count()
+}
+
+func (p *proxy) waitAccepting(ctx context.Context, addrs []string) error {
+	tick := time.NewTicker(proxyReadyInterval)
+	defer tick.Stop()
+	for _, addr := range addrs {
+		for {
+			c, err := net.DialTimeout(p.network, addr, proxyReadyInterval)
+			if err == nil {
+				c.Close()
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("graceful: an error occurred while waiting for the worker accepts on %s: %v", addr, ctx.Err())
+			case <-tick.C:
+			}
+		}
+	}
+	return nil
+}
+
+// acquire waits until the first generation is ready up to the start timeout,
+// and returns the backend of the current generation with incrementing its in-flight count.
+// returns errProxyClosed if the proxy is closed, e.g. the first generation fails to start.
+// the caller must release the backend.
+func (p *proxy) acquire(ctx context.Context) (*proxyBackend, error) {
+	if p.startTimeout > 0 {
+		var can context.CancelFunc
+		ctx, can = context.WithTimeout(ctx, p.startTimeout)
+		defer can()
+	}
+	select {
+	case <-p.ready:
+	case <-p.closed:
+		return nil, errProxyClosed
+	case <-ctx.Done():
+		return nil, fmt.Errorf("graceful: an error occurred while waiting for the worker is ready: %v", ctx.Err())
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.current
+	b.acquire()
+	return b, nil
+}
+
+func (p *proxy) acceptLoop(i int, ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(proxyReadyInterval)
+				continue
+			}
+			return
+		}
+		go p.handle(i, c)
+	}
+}
+
+// handle proxies the connection to the current worker generation.
+// the connection keeps the worker until it is closed, even if the worker is restarted.
+func (p *proxy) handle(i int, c net.Conn) {
+	defer c.Close()
+	b, err := p.acquire(context.Background())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer b.release()
+	bc, err := net.Dial(p.network, b.addrs[i])
+	if err != nil {
+		log.Printf("graceful: failed to connect to the worker %s: %v", b.addrs[i], err)
+		return
+	}
+	defer bc.Close()
+	done := make(chan struct{}, 2)
+	go proxyCopy(bc, c, done)
+	go proxyCopy(c, bc, done)
+	<-done
+	<-done
+}
+
+// proxyCopy copies from src to dst, and closes the write side of dst
+func proxyCopy(dst, src net.Conn, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+	io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	dst.Close()
+}
+
+type proxyBackendKey struct{}
+
+// reverseProxy returns the handler that reverse proxies the requests to the i-th backend addr
+// of the current worker generation, chosen for each request.
+func (p *proxy) reverseProxy(i int) http.Handler {
+	rp := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			b := r.Context().Value(proxyBackendKey{}).(*proxyBackend)
+			r.URL.Scheme = "http"
+			r.URL.Host = b.addrs[i]
+		},
+		Transport: p.transport,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := p.acquire(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer b.release()
+		rp.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyBackendKey{}, b)))
+	})
+}
+
+func (b *proxyBackend) acquire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight++
+}
+
+func (b *proxyBackend) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight--
+	if b.inflight == 0 && b.idle != nil {
+		close(b.idle)
+		b.idle = nil
+	}
+}
+
+// count returns the in-flight count, 0 if the backend is nil
+func (b *proxyBackend) count() int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inflight
+}
+
+// waitIdle waits until the in-flight count becomes 0.
+// the backend must not be acquired any more.
+func (b *proxyBackend) waitIdle(ctx context.Context) error {
+	b.mu.Lock()
+	n := b.inflight
+	if n == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	if b.idle == nil {
+		b.idle = make(chan struct{})
+	}
+	idle := b.idle
+	b.mu.Unlock()
+	log.Printf("graceful: waiting for %d in-flight requests of the old worker", n)
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("graceful: an error occurred while waiting for the in-flight requests of the old worker: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,208 @@
+package graceful
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxy_TCP(t *testing.T) {
+	ln1, ln2 := listenTCP(t), listenTCP(t)
+	defer ln1.Close()
+	defer ln2.Close()
+
+	g := NewGraceful()
+	// the second listener is passed only by GRACEFUL_PROXY_LISTENERS, not by PORT
+	done := serveTestWorker(t, g, WithListeners(ln1, ln2), WithProxy("tcp"))
+	testProxyRestart(t, g, "tcp", ln1.Addr().String(), ln2.Addr().String())
+	shutdownTestWorker(t, done)
+}
+
+func TestProxy_Unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	g := NewGraceful()
+	done := serveTestWorker(t, g, WithListeners(ln), WithProxy("unix"))
+	testProxyRestart(t, g, "unix", path)
+	shutdownTestWorker(t, done)
+}
+
+// testProxyRestart checks that the connections to the addrs are proxied to the same worker,
+// and to the new worker after the restart
+func testProxyRestart(t *testing.T, g *Graceful, network string, addrs ...string) {
+	t.Helper()
+	pid1 := workerPid(t, network, addrs[0])
+	if pid1 == os.Getpid() {
+		t.Fatalf("pid got %d, want the worker", pid1)
+	}
+	for _, addr := range addrs[1:] {
+		if pid := workerPid(t, network, addr); pid != pid1 {
+			t.Errorf("pid of %s got %d, want %d", addr, pid, pid1)
+		}
+	}
+	if err := g.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	// the new connections are proxied to the new generation as soon as the restart returns
+	pid2 := workerPid(t, network, addrs[0])
+	if pid2 == pid1 {
+		t.Errorf("pid got %d, want the new worker", pid2)
+	}
+	for _, addr := range addrs[1:] {
+		if pid := workerPid(t, network, addr); pid != pid2 {
+			t.Errorf("pid of %s got %d, want %d", addr, pid, pid2)
+		}
+	}
+}
+
+func TestProxy_AcquireBeforeReady(t *testing.T) {
+	p := &proxy{startTimeout: 50 * time.Millisecond, ready: make(chan struct{}), closed: make(chan struct{})}
+	start := time.Now()
+	if _, err := p.acquire(context.Background()); err == nil {
+		t.Fatal("acquire got no error before the worker is ready")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("acquire waits %v, want the start timeout", d)
+	}
+
+	// the connections waiting for the first worker are released when the start fails
+	p = &proxy{ready: make(chan struct{}), closed: make(chan struct{})}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := p.acquire(context.Background())
+		errCh <- err
+	}()
+	p.close()
+	select {
+	case err := <-errCh:
+		if err != errProxyClosed {
+			t.Errorf("acquire got %v, want errProxyClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire does not return after the proxy is closed")
+	}
+}
+
+func TestProxy_HTTPCutover(t *testing.T) {
+	release := make(chan struct{})
+	newBackend := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-release
+			}
+			io.WriteString(w, body)
+		}))
+	}
+	ts1, ts2 := newBackend("1"), newBackend("2")
+	defer ts1.Close()
+	defer ts2.Close()
+
+	ln := listenTCP(t)
+	p, err := newProxy("http", &option{listeners: []net.Listener{ln}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.serve()
+	defer p.close()
+	switchTo := func(ts *httptest.Server) {
+		p.mu.Lock()
+		p.pending = &proxyBackend{addrs: []string{ts.Listener.Addr().String()}}
+		p.mu.Unlock()
+		if err := p.waitReadyFunc(nil)(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	url := "http://" + ln.Addr().String()
+	var dials int32
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	get := func(c *http.Client, path string) (string, error) {
+		res, err := c.Get(url + path)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		return string(b), err
+	}
+
+	switchTo(ts1)
+	if body, err := get(client, "/"); err != nil || body != "1" {
+		t.Fatalf("body got %q, %v, want 1", body, err)
+	}
+	// the slow request is in-flight on the first generation
+	slowCh := make(chan string, 1)
+	go func() {
+		body, err := get(&http.Client{Transport: &http.Transport{}}, "/slow")
+		if err != nil {
+			t.Error(err)
+		}
+		slowCh <- body
+	}()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if cur, _ := p.inFlight(); cur == 1 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the slow request is not in-flight")
+		}
+	}
+
+	// the next request on the same keep-alive connection is proxied to the new generation
+	switchTo(ts2)
+	if body, err := get(client, "/"); err != nil || body != "2" {
+		t.Fatalf("body got %q, %v, want 2", body, err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("dials got %d, want 1", n)
+	}
+	if cur, old := p.inFlight(); cur != 0 || old != 1 {
+		t.Errorf("inFlight got %d, %d, want 0, 1", cur, old)
+	}
+
+	// the old generation is idle after the slow request is done
+	idleCh := make(chan error, 1)
+	go func() { idleCh <- p.waitIdle(context.Background()) }()
+	select {
+	case err := <-idleCh:
+		t.Fatalf("waitIdle returns %v while the request is in-flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-idleCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitIdle does not return after the request is done")
+	}
+	if body := <-slowCh; body != "1" {
+		t.Errorf("body of the slow request got %q, want 1", body)
+	}
+	if cur, old := p.inFlight(); cur != 0 || old != 0 {
+		t.Errorf("inFlight got %d, %d, want 0, 0", cur, old)
+	}
+}
@@ -0,0 +1,192 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kei2100/go-graceful/worker"
+)
+
+// envReusePortKey is the env key of the addrs that the worker binds by itself with SO_REUSEPORT.
+// the format of the entries is same as GRACEFUL_LISTENERS
+const envReusePortKey = "GRACEFUL_REUSEPORT_LISTENERS"
+
+// reusePortReadyInterval is the interval to check that the new worker has bound the addrs
+const reusePortReadyInterval = 100 * time.Millisecond
+
+// reusePortEntries lists the entries of GRACEFUL_REUSEPORT_LISTENERS
+func reusePortEntries() ([]inheritedEntry, error) {
+	return addrEntries(envReusePortKey)
+}
+
+// addrEntries lists the entries of the env key, the addrs that the worker binds by itself
+func addrEntries(key string) ([]inheritedEntry, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil, nil
+	}
+	ss := strings.Split(v, envSep)
+	entries := make([]inheritedEntry, 0, len(ss))
+	for _, s := range ss {
+		e, err := parseInheritedEntry(s)
+		if err != nil {
+			return nil, err
+		}
+		e.reusePort = true
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func listenReusePort(network, addr string) (net.Listener, error) {
+	if strings.HasPrefix(network, "unix") {
+		// the unix domain sockets do not support SO_REUSEPORT. the addr is bound only by this worker in the proxy mode,
+		// so the socket file left by the crashed worker is removed
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+		return net.Listen(network, addr)
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to listen with SO_REUSEPORT: %v", err)
+	}
+	return ln, nil
+}
+
+func listenPacketReusePort(network, addr string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	pc, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to listen packet with SO_REUSEPORT: %v", err)
+	}
+	return pc, nil
+}
+
+// reusePortEnv returns env var of the addrs that the worker binds by itself.
+// e.g. GRACEFUL_REUSEPORT_LISTENERS=tcp:0.0.0.0:8080;admin=tcp:127.0.0.1:9000
+// this func only for supervisor process
+func reusePortEnv(entries []inheritedEntry) []string {
+	if len(entries) == 0 {
+		return nil
+	}
+	ss := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ss = append(ss, e.String())
+	}
+	return []string{fmt.Sprintf("%s=%s", envReusePortKey, strings.Join(ss, envSep))}
+}
+
+// createReusePortEntries creates the entries of the reuseport addrs, ordered by addrs and named addrs sorted by name.
+// this func only for supervisor process
+func createReusePortEntries(o *option) []inheritedEntry {
+	names := make([]string, 0, len(o.namedReusePortAddrs))
+	for name := range o.namedReusePortAddrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]inheritedEntry, 0, len(o.reusePortAddrs)+len(names))
+	for _, addr := range o.reusePortAddrs {
+		entries = append(entries, inheritedEntry{network: addr.Network(), addr: addr.String(), reusePort: true})
+	}
+	for _, name := range names {
+		addr := o.namedReusePortAddrs[name]
+		entries = append(entries, inheritedEntry{name: name, network: addr.Network(), addr: addr.String(), reusePort: true})
+	}
+	return entries
+}
+
+// reusePortWaitReadyFunc returns WaitReadyFunc that waits until the new worker binds all the addrs,
+// so that the old worker is not stopped before the new one accepts.
+// then waitReadyFunc is called if not nil.
+// this func only for supervisor process
+func reusePortWaitReadyFunc(entries []inheritedEntry, waitReadyFunc func(context.Context, []net.Conn) error) func(context.Context, []net.Conn) error {
+	return func(ctx context.Context, conns []net.Conn) error {
+		pid, ok := worker.PidFromContext(ctx)
+		if ok {
+			if err := waitReusePortBound(ctx, pid, entries); err != nil {
+				return err
+			}
+		}
+		if waitReadyFunc == nil {
+			return nil
+		}
+		return waitReadyFunc(ctx, conns)
+	}
+}
+
+func waitReusePortBound(ctx context.Context, pid int, entries []inheritedEntry) error {
+	tick := time.NewTicker(reusePortReadyInterval)
+	defer tick.Stop()
+	for {
+		bound, err := processBoundAddrs(pid)
+		if err == errBoundAddrsNotSupported {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if allBound(entries, bound) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("graceful: an error occurred while waiting for the worker binds the addrs: %v", ctx.Err())
+		case <-tick.C:
+		}
+	}
+}
+
+func allBound(entries []inheritedEntry, bound []boundAddr) bool {
+	for _, e := range entries {
+		found := false
+		for _, b := range bound {
+			if sameNetwork(e.network, b.network) && sameAddr(e.addr, b.addr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sameAddr reports whether the host:port addrs are same.
+// the unspecified hosts such as "", 0.0.0.0 and :: are treated as same.
+func sameAddr(a, b string) bool {
+	ahost, aport, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	bhost, bport, err := net.SplitHostPort(b)
+	if err != nil {
+		return false
+	}
+	if aport != bport {
+		return false
+	}
+	aip, bip := net.ParseIP(ahost), net.ParseIP(bhost)
+	unspecified := func(host string, ip net.IP) bool { return host == "" || ip != nil && ip.IsUnspecified() }
+	if unspecified(ahost, aip) || unspecified(bhost, bip) {
+		return unspecified(ahost, aip) && unspecified(bhost, bip)
+	}
+	if aip == nil || bip == nil {
+		return ahost == bhost
+	}
+	return aip.Equal(bip)
+}
+
+// boundAddr represents the address that a process is listening on
+type boundAddr struct {
+	network string
+	addr    string
+}
@@ -0,0 +1,118 @@
+package graceful
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// soReusePort is SO_REUSEPORT of linux, which is not defined by the syscall package
+const soReusePort = 0xf
+
+var errBoundAddrsNotSupported = errors.New("graceful: listing bound addrs is not supported")
+
+// processBoundAddrs lists the addrs that the process and its descendants are listening on,
+// from /proc/<pid>/fd and /proc/net
+func processBoundAddrs(pid int) ([]boundAddr, error) {
+	inodes := make(map[string]bool)
+	for _, p := range append([]int{pid}, descendantPids(pid)...) {
+		links, err := filepath.Glob(fmt.Sprintf("/proc/%d/fd/*", p))
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range links {
+			dst, err := os.Readlink(l)
+			if err != nil || !strings.HasPrefix(dst, "socket:[") {
+				continue
+			}
+			inodes[strings.TrimSuffix(strings.TrimPrefix(dst, "socket:["), "]")] = true
+		}
+	}
+
+	bound := make([]boundAddr, 0)
+	for _, network := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		b, err := ioutil.ReadFile(filepath.Join("/proc/net", network))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("graceful: failed to read /proc/net/%s: %v", network, err)
+		}
+		for _, line := range strings.Split(string(b), "\n")[1:] {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(line)
+			if len(fields) < 10 || !inodes[fields[9]] {
+				continue
+			}
+			const tcpListen = "0A"
+			if strings.HasPrefix(network, "tcp") && fields[3] != tcpListen {
+				continue
+			}
+			addr, err := parseProcNetAddr(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			bound = append(bound, boundAddr{network: strings.TrimSuffix(network, "6"), addr: addr})
+		}
+	}
+	return bound, nil
+}
+
+// parseProcNetAddr parses the address of /proc/net/tcp. e.g. 0100007F:1F90 => 127.0.0.1:8080
+func parseProcNetAddr(s string) (string, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", fmt.Errorf("graceful: invalid address %s", s)
+	}
+	b, err := hex.DecodeString(s[:i])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return "", fmt.Errorf("graceful: invalid address %s", s)
+	}
+	// the address is stored as the 32 bit words of host byte order
+	for w := 0; w < len(b); w += 4 {
+		b[w], b[w+1], b[w+2], b[w+3] = b[w+3], b[w+2], b[w+1], b[w]
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("graceful: invalid address %s", s)
+	}
+	return net.JoinHostPort(net.IP(b).String(), strconv.Itoa(int(port))), nil
+}
+
+// descendantPids lists the pids of the descendant processes from /proc/<pid>/stat
+func descendantPids(pid int) []int {
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	children := make(map[int][]int)
+	for _, st := range stats {
+		b, err := ioutil.ReadFile(st)
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid ...
+		s := string(b)
+		fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		p, _ := strconv.Atoi(filepath.Base(filepath.Dir(st)))
+		ppid, _ := strconv.Atoi(fields[1])
+		children[ppid] = append(children[ppid], p)
+	}
+	var pids []int
+	queue := []int{pid}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, c := range children[p] {
+			pids = append(pids, c)
+			queue = append(queue, c)
+		}
+	}
+	return pids
+}
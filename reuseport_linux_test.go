@@ -0,0 +1,110 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWaitReusePortBound(t *testing.T) {
+	ln1, err := listenReusePort("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	addr := ln1.Addr().String()
+	// the next generation binds the same port
+	ln2, err := listenReusePort("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+
+	entries := []inheritedEntry{{network: "tcp", addr: addr, reusePort: true}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := waitReusePortBound(ctx, os.Getpid(), entries); err != nil {
+		t.Errorf("waitReusePortBound of the bound addr returns %v", err)
+	}
+
+	unbound := listenTCP(t)
+	unboundAddr := unbound.Addr().String()
+	unbound.Close()
+	entries = append(entries, inheritedEntry{network: "tcp", addr: unboundAddr, reusePort: true})
+	ctx, cancel = context.WithTimeout(context.Background(), 3*reusePortReadyInterval)
+	defer cancel()
+	if err := waitReusePortBound(ctx, os.Getpid(), entries); err == nil {
+		t.Error("waitReusePortBound of the unbound addr returns nil")
+	}
+}
+
+func TestGraceful_ReusePort(t *testing.T) {
+	ln := listenTCP(t)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	// the workers take a while to bind the addr by themselves
+	g := NewGraceful()
+	done := serveTestWorker(t, g, WithReusePortAddrs(addr),
+		WithEnv(append(os.Environ(), envTestWorker+"=1", envTestBindDelay+"=300ms")...))
+	var pid1 int
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if c, err := net.Dial("tcp", addr.String()); err == nil {
+			c.Close()
+			pid1 = workerPid(t, "tcp", addr.String())
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the first worker does not bind the addr")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the old worker is stopped only after the new one binds the addr, so the addr is always accepting
+	restarted := make(chan error, 1)
+	go func() { restarted <- g.Restart() }()
+	var refused error
+	for wait := true; wait; {
+		select {
+		case err := <-restarted:
+			if err != nil {
+				t.Error(err)
+			}
+			wait = false
+		default:
+		}
+		if c, err := net.Dial("tcp", addr.String()); err == nil {
+			c.Close()
+		} else if isConnRefused(err) {
+			// the conns in the accept queue of the closed old listener are reset, that is the nature of SO_REUSEPORT
+			refused = err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if refused != nil {
+		t.Errorf("the addr is not accepting while restarting: %v", refused)
+	}
+	if pid2 := workerPid(t, "tcp", addr.String()); pid2 == pid1 {
+		t.Errorf("pid got %d, want the new worker", pid2)
+	}
+	for deadline := time.Now().Add(5 * time.Second); syscall.Kill(pid1, 0) == nil; {
+		if time.Now().After(deadline) {
+			t.Errorf("the old worker %d is not stopped", pid1)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdownTestWorker(t, done)
+}
+
+func isConnRefused(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok {
+			return se.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package graceful
+
+import (
+	"errors"
+	"syscall"
+)
+
+const soReusePort = syscall.SO_REUSEPORT
+
+var errBoundAddrsNotSupported = errors.New("graceful: listing bound addrs is not supported")
+
+// processBoundAddrs is not supported on this platform.
+// the supervisor relies on the StopOldDelay to wait for the new worker.
+func processBoundAddrs(pid int) ([]boundAddr, error) {
+	return nil, errBoundAddrsNotSupported
+}
@@ -0,0 +1,86 @@
+package graceful
+
+import "testing"
+
+func TestSameAddr(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "127.0.0.1:8080", b: "127.0.0.1:8080", want: true},
+		{a: "127.0.0.1:8080", b: "127.0.0.1:8081", want: false},
+		{a: "127.0.0.1:8080", b: "127.0.0.2:8080", want: false},
+		{a: ":8080", b: "0.0.0.0:8080", want: true},
+		{a: ":8080", b: "[::]:8080", want: true},
+		{a: "0.0.0.0:8080", b: "[::]:8080", want: true},
+		{a: ":8080", b: "127.0.0.1:8080", want: false},
+		{a: "127.0.0.1:8080", b: "[::]:8080", want: false},
+		{a: "[::1]:8080", b: "[::1]:8080", want: true},
+		{a: "[::1]:8080", b: "[0:0:0:0:0:0:0:1]:8080", want: true},
+		{a: "[::1]:8080", b: "127.0.0.1:8080", want: false},
+		{a: "[fe80::1]:8080", b: "[fe80::2]:8080", want: false},
+		{a: "[::ffff:127.0.0.1]:8080", b: "127.0.0.1:8080", want: true},
+		{a: "localhost:8080", b: "localhost:8080", want: true},
+		{a: "localhost:8080", b: "127.0.0.1:8080", want: false},
+		{a: "127.0.0.1", b: "127.0.0.1", want: false},
+	}
+	for _, tt := range tests {
+		if got := sameAddr(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameAddr(%q, %q) got %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := sameAddr(tt.b, tt.a); got != tt.want {
+			t.Errorf("sameAddr(%q, %q) got %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestAllBound(t *testing.T) {
+	bound := []boundAddr{
+		{network: "tcp", addr: "0.0.0.0:8080"},
+		{network: "tcp", addr: "127.0.0.1:9000"},
+		{network: "udp", addr: "[::]:5353"},
+		{network: "tcp", addr: "[::1]:9001"},
+	}
+	tests := []struct {
+		name    string
+		entries []inheritedEntry
+		want    bool
+	}{
+		{name: "no entries", want: true},
+		{
+			name: "all bound",
+			entries: []inheritedEntry{
+				{network: "tcp", addr: ":8080"},
+				{network: "tcp4", addr: "127.0.0.1:9000"},
+				{network: "udp6", addr: "[::]:5353"},
+				{network: "tcp6", addr: "[::1]:9001"},
+			},
+			want: true,
+		},
+		{
+			name:    "unbound port",
+			entries: []inheritedEntry{{network: "tcp", addr: ":8080"}, {network: "tcp", addr: ":8081"}},
+			want:    false,
+		},
+		{
+			name:    "other network",
+			entries: []inheritedEntry{{network: "udp", addr: ":8080"}},
+			want:    false,
+		},
+		{
+			name:    "other host",
+			entries: []inheritedEntry{{network: "tcp", addr: "127.0.0.2:9000"}},
+			want:    false,
+		},
+		{
+			name:    "ipv6 loopback is not ipv4",
+			entries: []inheritedEntry{{network: "tcp", addr: "127.0.0.1:9001"}},
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		if got := allBound(tt.entries, bound); got != tt.want {
+			t.Errorf("%s: allBound got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
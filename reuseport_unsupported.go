@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+var errBoundAddrsNotSupported = errors.New("graceful: listing bound addrs is not supported")
+
+// processBoundAddrs is not supported on this platform
+func processBoundAddrs(pid int) ([]boundAddr, error) {
+	return nil, errBoundAddrsNotSupported
+}
+
+// reusePortControl fails since SO_REUSEPORT is not supported on this platform
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return fmt.Errorf("graceful: SO_REUSEPORT is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,49 @@
+package graceful
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// tcpFastOpen is TCP_FASTOPEN, not defined in the syscall package
+const tcpFastOpen = 0x17
+
+func setFreeBind(fd int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_FREEBIND, 1); err != nil {
+		return fmt.Errorf("graceful: failed to set IP_FREEBIND: %v", err)
+	}
+	return nil
+}
+
+func bindToDevice(fd int, device string) error {
+	if err := syscall.BindToDevice(fd, device); err != nil {
+		return fmt.Errorf("graceful: failed to set SO_BINDTODEVICE %s: %v", device, err)
+	}
+	return nil
+}
+
+func setKeepAlivePeriod(fd int, period time.Duration) error {
+	secs := roundSeconds(period)
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs); err != nil {
+		return fmt.Errorf("graceful: failed to set TCP_KEEPIDLE: %v", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs); err != nil {
+		return fmt.Errorf("graceful: failed to set TCP_KEEPINTVL: %v", err)
+	}
+	return nil
+}
+
+func setDeferAccept(fd int, timeout time.Duration) error {
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, roundSeconds(timeout)); err != nil {
+		return fmt.Errorf("graceful: failed to set TCP_DEFER_ACCEPT: %v", err)
+	}
+	return nil
+}
+
+func setFastOpen(fd int, qlen int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, qlen); err != nil {
+		return fmt.Errorf("graceful: failed to set TCP_FASTOPEN: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+func setFreeBind(fd int) error {
+	return errSockoptNotSupported("IP_FREEBIND")
+}
+
+func bindToDevice(fd int, device string) error {
+	return errSockoptNotSupported("SO_BINDTODEVICE")
+}
+
+func setKeepAlivePeriod(fd int, period time.Duration) error {
+	return errSockoptNotSupported("the keep-alive period")
+}
+
+func setDeferAccept(fd int, timeout time.Duration) error {
+	return errSockoptNotSupported("TCP_DEFER_ACCEPT")
+}
+
+func setFastOpen(fd int, qlen int) error {
+	return errSockoptNotSupported("TCP_FASTOPEN")
+}
+
+func errSockoptNotSupported(opt string) error {
+	return fmt.Errorf("graceful: %s is not supported on %s", opt, runtime.GOOS)
+}
@@ -0,0 +1,84 @@
+package supervisor
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// environment variables of the fds passed to each worker generation
+const (
+	// EnvControlFD is the env key of the fd of the control socket between the supervisor and the worker
+	EnvControlFD = "GRACEFUL_CONTROL_FD"
+	// EnvHandoffFD is the env key of the fd of the handoff socket from the previous worker generation
+	EnvHandoffFD = "GRACEFUL_HANDOFF_FD"
+	// EnvConnHandoffFD is the env key of the fd of the socket receiving the connections handed off by the previous worker generation
+	EnvConnHandoffFD = "GRACEFUL_CONN_HANDOFF_FD"
+)
+
+// ControlHandoff is the message sent on the control socket with the handoff socket
+// and the connection handoff socket to the next worker generation
+const ControlHandoff = 'h'
+
+// ControlShutdown is the message sent on the control socket before the worker is stopped
+// without the next worker generation
+const ControlShutdown = 'q'
+
+// generation holds the sockets of a worker generation
+type generation struct {
+	control     *os.File   // the supervisor end of the control socket
+	workerFiles []*os.File // passed to the worker process
+	env         []string
+	files       []*os.File // the files of GenerationFilesFunc
+}
+
+// newGeneration creates the control socket and the env for a worker generation.
+// handoff and connHandoff are the sockets from the previous generation, they may be nil.
+// the fds in the worker process start from firstFD.
+func newGeneration(firstFD int, handoff, connHandoff *os.File) (*generation, error) {
+	control, workerControl, err := socketpair("control")
+	if err != nil {
+		return nil, err
+	}
+	g := &generation{
+		control:     control,
+		workerFiles: []*os.File{workerControl},
+		env:         []string{fmt.Sprintf("%s=%d", EnvControlFD, firstFD)},
+	}
+	if handoff != nil {
+		g.workerFiles = append(g.workerFiles, handoff)
+		g.env = append(g.env, fmt.Sprintf("%s=%d", EnvHandoffFD, firstFD+len(g.workerFiles)-1))
+	}
+	if connHandoff != nil {
+		g.workerFiles = append(g.workerFiles, connHandoff)
+		g.env = append(g.env, fmt.Sprintf("%s=%d", EnvConnHandoffFD, firstFD+len(g.workerFiles)-1))
+	}
+	return g, nil
+}
+
+// sendShutdown tells the worker that it is stopped without the next generation
+func (g *generation) sendShutdown() {
+	if g.control == nil {
+		return
+	}
+	if _, err := g.control.Write([]byte{ControlShutdown}); err != nil {
+		log.Printf("supervisor: failed to send the shutdown message: %v", err)
+	}
+}
+
+func (g *generation) close() {
+	closeFiles(g.files)
+	if g.control == nil {
+		return
+	}
+	closeFiles(append([]*os.File{g.control}, g.workerFiles...))
+}
+
+// closeOnDone closes the sockets of the generation when the worker is done
+func (g *generation) closeOnDone(done <-chan struct{}) {
+	go func() {
+		for range done {
+		}
+		g.close()
+	}()
+}
@@ -0,0 +1,38 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// sendHandoff sends the handoff socket and the connection handoff socket
+// to the next generation through the control socket
+func (g *generation) sendHandoff(handoff, connHandoff *os.File) error {
+	if g.control == nil {
+		return fmt.Errorf("supervisor: the worker has no control socket")
+	}
+	rights := syscall.UnixRights(int(handoff.Fd()), int(connHandoff.Fd()))
+	if err := syscall.Sendmsg(int(g.control.Fd()), []byte{ControlHandoff}, rights, nil, 0); err != nil {
+		return fmt.Errorf("supervisor: failed to send the handoff socket: %v", err)
+	}
+	return nil
+}
+
+// socketpair creates a pair of connected unix domain sockets
+func socketpair(name string) (*os.File, *os.File, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("supervisor: failed to create %s socketpair: %v", name, err)
+	}
+	return os.NewFile(uintptr(fds[0]), name), os.NewFile(uintptr(fds[1]), name), nil
+}
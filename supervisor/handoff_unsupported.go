@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// sendHandoff is not supported on this platform
+func (g *generation) sendHandoff(handoff, connHandoff *os.File) error {
+	return fmt.Errorf("supervisor: the handoff is not supported on %s", runtime.GOOS)
+}
+
+// socketpair is not supported on this platform, so HandoffEnabled fails to start the worker
+func socketpair(name string) (*os.File, *os.File, error) {
+	return nil, nil, fmt.Errorf("supervisor: failed to create %s socketpair: not supported on %s", name, runtime.GOOS)
+}
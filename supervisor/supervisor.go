@@ -21,23 +21,114 @@ type Supervisor struct {
 	WaitReadyFunc func(ctx context.Context, extraFileConns []net.Conn) error
 
 	AutoRestartEnabled bool
+	RestartPolicy      worker.RestartPolicy
 	StartTimeout       time.Duration
 	StopOldDelay       time.Duration
 
-	worker   *worker.Worker
-	workerMu sync.RWMutex
+	// HandoffEnabled enables the handoff socket between the old and the new worker generations.
+	// each worker gets a control socket (EnvControlFD), and on restart,
+	// the new worker gets one end of a socketpair (EnvHandoffFD)
+	// and the other end is sent to the old worker through its control socket.
+	// the socketpair for the connection handoff (EnvConnHandoffFD) is passed in the same way.
+	// on shutdown, ControlShutdown is sent through the control socket before the worker is stopped.
+	HandoffEnabled bool
+
+	// GenerationEnvFunc returns the additional env of each worker generation if not nil.
+	// it is called before the worker of the generation is started.
+	GenerationEnvFunc func() ([]string, error)
+
+	// GenerationFilesFunc returns the files of each worker generation if not nil.
+	// they are passed to the worker process before the ExtraFiles, so the ExtraFiles start from 3+len(files).
+	// the files are closed when the worker of the generation is done.
+	GenerationFilesFunc func() ([]*os.File, error)
+
+	// WaitIdleFunc waits until the old worker generation is idle on restart if not nil,
+	// then the old worker is stopped. StopOldDelay is not used if it is set.
+	WaitIdleFunc func(ctx context.Context) error
+
+	// SubreaperEnabled makes the supervisor process the subreaper of the workers' descendants.
+	// see worker.EnableSubreaper
+	SubreaperEnabled bool
+
+	// Credential is the user and the groups of the worker processes. see worker.Worker
+	Credential *worker.Credential
+
+	worker     *worker.Worker
+	generation *generation
+	workerMu   sync.RWMutex
 
 	chanCloseMonitor chanCloseMonitor
 }
 
 // Start Supervisor
-// blocks until the worker process is done
+// blocks until the worker process is done.
+// returns the error of the worker if it is done by itself, worker.ExitError or worker.CrashLoopError
 func (s *Supervisor) Start(ctx context.Context) error {
+	if s.SubreaperEnabled {
+		if err := worker.EnableSubreaper(); err != nil {
+			return err
+		}
+	}
 	if err := s.startWorker(ctx); err != nil {
 		return err
 	}
 	<-s.chanCloseMonitor.Done()
-	return nil
+	return s.workerErr()
+}
+
+// Adopt adopts the running worker process instead of starting a new one.
+// the handoff is not available from the adopted worker.
+// blocks until the worker process is done
+func (s *Supervisor) Adopt(pid int) error {
+	s.workerMu.Lock() // worker LOCK
+	wk, gen, err := s.newWorker(nil, nil)
+	if err != nil {
+		s.workerMu.Unlock() // worker UNLOCK
+		return err
+	}
+	s.worker, s.generation = wk, gen
+	s.workerMu.Unlock() // worker UNLOCK
+
+	if err := wk.Adopt(pid); err != nil {
+		gen.close()
+		return fmt.Errorf("supervisor: failed to adopt worker: %v", err)
+	}
+	log.Printf("supervisor: adopted worker. pid=%d", pid)
+	// after the adoption, so that the adopted worker is not reaped as an orphan
+	if s.SubreaperEnabled {
+		if err := worker.EnableSubreaper(); err != nil {
+			log.Println(err)
+		}
+	}
+	// the generation is used when the worker is auto restarted
+	gen.closeOnDone(wk.Done())
+	s.chanCloseMonitor.addDone(wk.Done())
+	<-s.chanCloseMonitor.Done()
+	return s.workerErr()
+}
+
+// WorkerPid returns the pid of the current worker process
+func (s *Supervisor) WorkerPid() int {
+	s.workerMu.RLock()
+	defer s.workerMu.RUnlock()
+	return s.worker.Pid()
+}
+
+func (s *Supervisor) workerErr() error {
+	s.workerMu.RLock()
+	defer s.workerMu.RUnlock()
+	return s.worker.Err()
+}
+
+// Signal sends the signal to the current worker process and its process group
+func (s *Supervisor) Signal(sig os.Signal) error {
+	s.workerMu.RLock()
+	wk := s.worker
+	s.workerMu.RUnlock()
+	if wk == nil {
+		return fmt.Errorf("supervisor: worker is not started")
+	}
+	return wk.Signal(sig)
 }
 
 // RestartProcess graceful restarts worker process
@@ -56,49 +147,125 @@ func (s *Supervisor) Shutdown(ctx context.Context, stopSig os.Signal) error {
 	return nil
 }
 
+// SetProcessAttr replaces the attributes of the worker process.
+// they are used from the next worker start.
+func (s *Supervisor) SetProcessAttr(command string, args []string, extraFiles []*os.File, env []string) {
+	s.workerMu.Lock()         // worker LOCK
+	defer s.workerMu.Unlock() // worker UNLOCK
+	s.Command = command
+	s.Args = args
+	s.ExtraFiles = extraFiles
+	s.Env = env
+}
+
 func (s *Supervisor) startWorker(ctx context.Context) error {
 	s.workerMu.Lock() // worker LOCK
-	wk := &worker.Worker{
-		Command:       s.Command,
-		Args:          s.Args,
-		ExtraFiles:    s.ExtraFiles,
-		Env:           s.Env,
-		WaitReadyFunc: s.WaitReadyFunc,
-		StartTimeout:  s.StartTimeout,
+	wk, gen, err := s.newWorker(nil, nil)
+	if err != nil {
+		s.workerMu.Unlock() // worker UNLOCK
+		return err
 	}
-	wk.SetAutoRestart(s.AutoRestartEnabled)
-	s.worker = wk
+	s.worker, s.generation = wk, gen
 	s.workerMu.Unlock() // worker UNLOCK
 
 	if err := wk.Start(ctx); err != nil {
+		gen.close()
 		return fmt.Errorf("supervisor: failed to start new worker: %v", err)
 	}
+	gen.closeOnDone(wk.Done())
 	s.chanCloseMonitor.addDone(wk.Done())
 	return nil
 }
 
-func (s *Supervisor) restartWorker(ctx context.Context, stopSig os.Signal) error {
-	// renew worker
-	s.workerMu.Lock() // worker LOCK
-	oldwk := s.worker
-	newwk := &worker.Worker{
+// newWorker creates a new worker and its generation.
+// handoff and connHandoff are passed to the worker if not nil.
+// the caller must hold the workerMu.
+func (s *Supervisor) newWorker(handoff, connHandoff *os.File) (*worker.Worker, *generation, error) {
+	wk := &worker.Worker{
 		Command:       s.Command,
 		Args:          s.Args,
 		ExtraFiles:    s.ExtraFiles,
 		Env:           s.Env,
 		WaitReadyFunc: s.WaitReadyFunc,
 		StartTimeout:  s.StartTimeout,
+		Credential:    s.Credential,
+		RestartPolicy: s.RestartPolicy,
+	}
+	wk.SetAutoRestart(s.AutoRestartEnabled)
+	if s.GenerationEnvFunc != nil {
+		env, err := s.GenerationEnvFunc()
+		if err != nil {
+			return nil, nil, fmt.Errorf("supervisor: failed to create the env of the worker: %v", err)
+		}
+		wk.Env = append(append([]string{}, s.Env...), env...)
+	}
+	var files []*os.File
+	if s.GenerationFilesFunc != nil {
+		var err error
+		files, err = s.GenerationFilesFunc()
+		if err != nil {
+			return nil, nil, fmt.Errorf("supervisor: failed to create the files of the worker: %v", err)
+		}
+		wk.ExtraFiles = append(append([]*os.File{}, files...), s.ExtraFiles...)
+	}
+	if !s.HandoffEnabled {
+		return wk, &generation{files: files}, nil
+	}
+	gen, err := newGeneration(3+len(wk.ExtraFiles), handoff, connHandoff)
+	if err != nil {
+		closeFiles(files)
+		return nil, nil, err
+	}
+	gen.files = files
+	wk.ExtraFiles = append(append([]*os.File{}, wk.ExtraFiles...), gen.workerFiles...)
+	wk.Env = append(append([]string{}, wk.Env...), gen.env...)
+	return wk, gen, nil
+}
+
+func (s *Supervisor) restartWorker(ctx context.Context, stopSig os.Signal) error {
+	// renew worker
+	s.workerMu.Lock() // worker LOCK
+	oldwk, oldgen := s.worker, s.generation
+	var handoff, connHandoff *os.File
+	if s.HandoffEnabled {
+		// the old worker can write to the handoff sockets while the new worker is starting
+		var err error
+		handoff, connHandoff, err = s.sendHandoff(oldgen)
+		if err != nil {
+			s.workerMu.Unlock() // worker UNLOCK
+			return err
+		}
+	}
+	newwk, newgen, err := s.newWorker(handoff, connHandoff)
+	if err != nil {
+		s.workerMu.Unlock() // worker UNLOCK
+		if handoff != nil {
+			handoff.Close()
+			connHandoff.Close()
+		}
+		return err
 	}
-	newwk.SetAutoRestart(s.AutoRestartEnabled)
-	s.worker = newwk
+	s.worker, s.generation = newwk, newgen
 	s.workerMu.Unlock() // worker UNLOCK
 
 	if err := newwk.Start(ctx); err != nil {
+		newgen.close()
+		// the old worker keeps running
+		s.workerMu.Lock() // worker LOCK
+		s.worker, s.generation = oldwk, oldgen
+		s.workerMu.Unlock() // worker UNLOCK
 		return fmt.Errorf("supervisor: failed to start new worker: %v", err)
 	}
+	newgen.closeOnDone(newwk.Done())
 	s.chanCloseMonitor.addDone(newwk.Done())
 	// stop old worker
-	time.Sleep(s.StopOldDelay)
+	if s.WaitIdleFunc != nil {
+		if err := s.WaitIdleFunc(ctx); err != nil {
+			log.Printf("supervisor: old worker is not idle. %v", err)
+		}
+	} else {
+		time.Sleep(s.StopOldDelay)
+	}
 	if err := oldwk.Stop(ctx, stopSig); err != nil {
 		log.Printf("supervisor: failed to stop old worker. sig=%s. %v", stopSig, err)
 		log.Println("supervisor: force stopping old worker")
@@ -109,11 +276,35 @@ func (s *Supervisor) restartWorker(ctx context.Context, stopSig os.Signal) error
 	return nil
 }
 
+// sendHandoff creates the handoff socketpairs and sends the one ends to the old generation.
+// returns the other ends for the new generation.
+func (s *Supervisor) sendHandoff(oldgen *generation) (*os.File, *os.File, error) {
+	oldHandoff, handoff, err := socketpair("handoff")
+	if err != nil {
+		return nil, nil, err
+	}
+	oldConnHandoff, connHandoff, err := socketpair("conn-handoff")
+	if err != nil {
+		oldHandoff.Close()
+		handoff.Close()
+		return nil, nil, err
+	}
+	if err := oldgen.sendHandoff(oldHandoff, oldConnHandoff); err != nil {
+		log.Println(err)
+	}
+	oldHandoff.Close()
+	oldConnHandoff.Close()
+	return handoff, connHandoff, nil
+}
+
 func (s *Supervisor) shutdownWorker(ctx context.Context, stopSig os.Signal) error {
 	s.workerMu.Lock() // worker LOCK
-	wk := s.worker
+	wk, gen := s.worker, s.generation
 	s.workerMu.Unlock() // worker UNLOCK
 
+	if s.HandoffEnabled {
+		gen.sendShutdown()
+	}
 	if err := wk.Stop(ctx, stopSig); err != nil {
 		log.Printf("supervisor: failed to stop worker. sig=%s. %v", stopSig, err)
 		log.Println("supervisor: force stopping worker")
@@ -124,6 +315,14 @@ func (s *Supervisor) shutdownWorker(ctx context.Context, stopSig os.Signal) erro
 	return nil
 }
 
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			log.Printf("supervisor: failed to close the generation file: %v", err)
+		}
+	}
+}
+
 type chanCloseMonitor struct {
 	wg   sync.WaitGroup
 	done chan struct{}
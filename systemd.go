@@ -0,0 +1,125 @@
+package graceful
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// environment variables of systemd socket activation.
+// see sd_listen_fds(3)
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+)
+
+// listenFDsStart is the first fd passed by systemd
+const listenFDsStart = 3
+
+// SystemdSockets represents the sockets passed by systemd socket activation
+type SystemdSockets struct {
+	// Listeners are the stream sockets without FileDescriptorName
+	Listeners []net.Listener
+	// NamedListeners are the stream sockets named by FileDescriptorName
+	NamedListeners map[string]net.Listener
+	// PacketConns are the datagram sockets
+	PacketConns []net.PacketConn
+}
+
+// Close closes all sockets
+func (s *SystemdSockets) Close() {
+	closeListeners(s.Listeners)
+	for _, ln := range s.NamedListeners {
+		if err := ln.Close(); err != nil {
+			log.Printf("graceful: failed to close listener: %v", err)
+		}
+	}
+	closePacketConns(s.PacketConns)
+}
+
+// SystemdActivatedSockets adopts the sockets passed by systemd socket activation.
+// the sockets are ignored if LISTEN_PID does not match the current process.
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES are unset so that they do not leak to the worker processes.
+// this func only for supervisor process
+func SystemdActivatedSockets() (*SystemdSockets, error) {
+	defer unsetSystemdEnv()
+
+	socks := &SystemdSockets{
+		Listeners:      make([]net.Listener, 0),
+		NamedListeners: make(map[string]net.Listener),
+		PacketConns:    make([]net.PacketConn, 0),
+	}
+	entries, err := systemdEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := socks.adopt(e.fd, e.name); err != nil {
+			socks.Close()
+			return nil, err
+		}
+	}
+	return socks, nil
+}
+
+// systemdEntries lists the entries from LISTEN_FDS and LISTEN_FDNAMES.
+// no entries are returned if LISTEN_PID does not match the current process.
+func systemdEntries() ([]inheritedEntry, error) {
+	if os.Getenv(envListenPID) != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("graceful: invalid %s %q", envListenFDs, os.Getenv(envListenFDs))
+	}
+	var names []string
+	if v := os.Getenv(envListenFDNames); v != "" {
+		names = strings.Split(v, ":")
+	}
+	entries := make([]inheritedEntry, 0, n)
+	for i := 0; i < n; i++ {
+		e := inheritedEntry{fd: uintptr(listenFDsStart + i)}
+		if i < len(names) && names[i] != "unknown" {
+			e.name = names[i]
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *SystemdSockets) adopt(fd uintptr, name string) error {
+	f := os.NewFile(fd, name)
+	if f == nil {
+		return fmt.Errorf("graceful: failed to NewFile. fd %v, name %v", fd, name)
+	}
+	defer f.Close()
+
+	if ln, err := net.FileListener(f); err == nil {
+		if name == "" {
+			s.Listeners = append(s.Listeners, ln)
+			return nil
+		}
+		if _, ok := s.NamedListeners[name]; ok {
+			ln.Close()
+			return fmt.Errorf("graceful: duplicate %s %s", envListenFDNames, name)
+		}
+		s.NamedListeners[name] = ln
+		return nil
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return fmt.Errorf("graceful: failed to adopt the systemd socket. fd %v: %v", fd, err)
+	}
+	s.PacketConns = append(s.PacketConns, pc)
+	return nil
+}
+
+func unsetSystemdEnv() {
+	os.Unsetenv(envListenPID)
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenFDNames)
+}
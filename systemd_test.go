@@ -0,0 +1,138 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// envTestSystemd makes the test binary adopt the systemd sockets, see testSystemdWorker
+const envTestSystemd = "GRACEFUL_TEST_SYSTEMD"
+
+// testSystemdWorker prints the sockets adopted by SystemdActivatedSockets, and the LISTEN_* left in the env.
+// LISTEN_PID is set to the current process if envTestSystemd is "match", as systemd does
+func testSystemdWorker() {
+	if os.Getenv(envTestSystemd) == "match" {
+		os.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+	}
+	socks, err := SystemdActivatedSockets()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer socks.Close()
+	for _, ln := range socks.Listeners {
+		fmt.Println("listener", ln.Addr())
+	}
+	for name, ln := range socks.NamedListeners {
+		fmt.Println("named", name, ln.Addr())
+	}
+	for _, pc := range socks.PacketConns {
+		fmt.Println("packet", pc.LocalAddr())
+	}
+	for _, key := range []string{envListenPID, envListenFDs, envListenFDNames} {
+		if _, ok := os.LookupEnv(key); ok {
+			fmt.Println("env", key)
+		}
+	}
+}
+
+// runSystemdWorker runs testSystemdWorker with the files passed from fd 3, and returns its sorted output lines
+func runSystemdWorker(t *testing.T, mode string, files []*os.File, env ...string) []string {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), envTestSystemd+"="+mode, envListenFDs+"="+strconv.Itoa(len(files)))
+	cmd.Env = append(cmd.Env, env...)
+	cmd.ExtraFiles = files
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("the systemd worker fails: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		lines = nil
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestSystemdActivatedSockets(t *testing.T) {
+	defer saveEnv(envListenPID, envListenFDs, envListenFDNames)()
+	for _, key := range []string{envListenPID, envListenFDs, envListenFDNames} {
+		os.Unsetenv(key)
+	}
+	ln1, ln2 := listenTCP(t), listenTCP(t)
+	defer ln1.Close()
+	defer ln2.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var files []*os.File
+	for _, c := range []interface {
+		File() (*os.File, error)
+	}{ln1.(*net.TCPListener), ln2.(*net.TCPListener), pc.(*net.UDPConn)} {
+		f, err := c.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	tests := []struct {
+		name  string
+		mode  string
+		names string
+		want  []string
+	}{
+		{
+			name:  "names",
+			mode:  "match",
+			names: "unknown:web:dns",
+			want: []string{
+				"listener " + ln1.Addr().String(),
+				"named web " + ln2.Addr().String(),
+				"packet " + pc.LocalAddr().String(),
+			},
+		},
+		{
+			name: "no names",
+			mode: "match",
+			want: []string{
+				"listener " + ln1.Addr().String(),
+				"listener " + ln2.Addr().String(),
+				"packet " + pc.LocalAddr().String(),
+			},
+		},
+		{
+			// the sockets are for the other process, e.g. the parent that forgot to unset LISTEN_*
+			name:  "pid mismatch",
+			mode:  "mismatch",
+			names: "unknown:web:dns",
+		},
+	}
+	for _, tt := range tests {
+		env := []string{envListenFDNames + "=" + tt.names}
+		if tt.mode == "mismatch" {
+			env = append(env, envListenPID+"="+strconv.Itoa(os.Getpid()))
+		}
+		got := runSystemdWorker(t, tt.mode, files, env...)
+		sort.Strings(tt.want)
+		// LISTEN_* are unset after they are read in all cases
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
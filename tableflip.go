@@ -0,0 +1,143 @@
+package graceful
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+)
+
+// the convention of tableflip (github.com/cloudflare/tableflip).
+// the child process gets the write end of the ready pipe at fd 3, the names of the files
+// encoded by encoding/gob at fd 4, and the files from fd 5.
+const (
+	envTableflipSentinel = "TABLEFLIP_HAS_PARENT_7f9c"
+	tableflipReadyFD     = 3
+	tableflipNamesFD     = 4
+	tableflipFirstFD     = 5
+)
+
+// the kinds of the file names of tableflip
+const (
+	tableflipListenKind = "listener"
+	tableflipPacketKind = "packet"
+	tableflipFileKind   = "fd"
+)
+
+// tableflipNames returns the names of the entries and the named files in the order of the fds
+func tableflipNames(entries []inheritedEntry, fileNames []string) [][]string {
+	names := make([][]string, 0, len(entries)+len(fileNames))
+	for _, e := range entries {
+		kind := tableflipListenKind
+		if isPacketNetwork(e.network) {
+			kind = tableflipPacketKind
+		}
+		names = append(names, []string{kind, e.network, e.addr})
+	}
+	for _, name := range fileNames {
+		names = append(names, []string{tableflipFileKind, name, ""})
+	}
+	return names
+}
+
+// tableflip passes the files of each worker generation in the convention of tableflip.
+// this type only for supervisor process
+type tableflip struct {
+	names [][]string
+
+	mu      sync.Mutex
+	current *tableflipGeneration
+}
+
+// tableflipGeneration holds the supervisor ends of the ready and the names pipes of a worker generation
+type tableflipGeneration struct {
+	ready *os.File
+	names *os.File
+}
+
+// generationFiles creates the ready and the names pipes of the next worker generation,
+// and returns the worker ends of them. it is used as GenerationFilesFunc of the supervisor.
+// the supervisor ends are closed when the worker ends are closed by the supervisor and the workers.
+func (t *tableflip) generationFiles() ([]*os.File, error) {
+	ready, workerReady, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to create the tableflip ready pipe: %v", err)
+	}
+	workerNames, names, err := os.Pipe()
+	if err != nil {
+		ready.Close()
+		workerReady.Close()
+		return nil, fmt.Errorf("graceful: failed to create the tableflip names pipe: %v", err)
+	}
+	gen := &tableflipGeneration{ready: ready, names: names}
+	go gen.drainReady()
+	t.mu.Lock()
+	t.current = gen
+	t.mu.Unlock()
+	return []*os.File{workerReady, workerNames}, nil
+}
+
+// waitReadyFunc returns WaitReadyFunc that sends the names to the started worker process,
+// then waitReadyFunc is called if not nil. the names are sent on each start of the process,
+// since the auto restarted process reads them again.
+// this func only for supervisor process
+func (t *tableflip) waitReadyFunc(waitReadyFunc func(context.Context, []net.Conn) error) func(context.Context, []net.Conn) error {
+	return func(ctx context.Context, conns []net.Conn) error {
+		t.mu.Lock()
+		gen, names := t.current, t.names
+		t.mu.Unlock()
+		if err := gob.NewEncoder(gen.names).Encode(names); err != nil {
+			return fmt.Errorf("graceful: failed to send the tableflip names: %v", err)
+		}
+		if waitReadyFunc != nil {
+			return waitReadyFunc(ctx, conns)
+		}
+		return nil
+	}
+}
+
+// setNames replaces the names, that are sent from the next start of the worker process
+func (t *tableflip) setNames(names [][]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.names = names
+}
+
+// drainReady discards the ready notifications of the worker processes.
+// the worker process of tableflip is ready when it returns from Upgrader.Ready, which must not fail.
+// the pipes are closed when all the worker ends are closed.
+func (g *tableflipGeneration) drainReady() {
+	io.Copy(ioutil.Discard, g.ready)
+	g.ready.Close()
+	g.names.Close()
+}
+
+// tableflipEntries lists the entries from the names passed by the tableflip parent process,
+// and notifies the parent that this process is ready.
+// the files other than the listeners and the packet conns are skipped.
+func tableflipEntries() ([]inheritedEntry, error) {
+	rd := os.NewFile(tableflipNamesFD, "tableflip-names")
+	var names [][]string
+	if err := gob.NewDecoder(rd).Decode(&names); err != nil {
+		return nil, fmt.Errorf("graceful: failed to decode the tableflip names: %v", err)
+	}
+	// the parent process closes the names when it exits, which is not waited for
+	rd.Close()
+	entries := make([]inheritedEntry, 0, len(names))
+	for i, name := range names {
+		if len(name) < 1 || (name[0] != tableflipListenKind && name[0] != tableflipPacketKind) {
+			continue
+		}
+		entries = append(entries, inheritedEntry{fd: uintptr(tableflipFirstFD + i)})
+	}
+	wr := os.NewFile(tableflipReadyFD, "tableflip-ready")
+	defer wr.Close()
+	if _, err := wr.Write([]byte{1}); err != nil {
+		return nil, fmt.Errorf("graceful: failed to notify the tableflip parent: %v", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,246 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// messages of the takeover socket
+const (
+	// takeoverDrain is sent by the new supervisor process after its worker is started
+	takeoverDrain = 'd'
+	// takeoverReleased is sent by the running supervisor process after it closes the takeover socket
+	takeoverReleased = 'r'
+)
+
+// maxTakeoverEntries is the maximum length of the entries sent on the takeover socket
+const maxTakeoverEntries = 1 << 20
+
+// takeoverTimeout is the timeout to wait for the reply of the running supervisor process
+const takeoverTimeout = 10 * time.Second
+
+// ErrNoRunningSupervisor is returned when no supervisor process is serving on the takeover socket
+var ErrNoRunningSupervisor = errors.New("graceful: no running supervisor to take over")
+
+// Takeover represents the listeners taken over from the running supervisor process.
+// pass it to Serve with WithTakeover, then the running supervisor process stops its worker and exits
+// after the worker of this supervisor process is started.
+type Takeover struct {
+	Listeners      []net.Listener
+	NamedListeners map[string]net.Listener
+	PacketConns    []net.PacketConn
+
+	conn     *net.UnixConn
+	once     sync.Once
+	released chan struct{}
+}
+
+// TakeoverListeners connects to the takeover socket of the running supervisor process,
+// and receives its listeners and packet conns.
+// returns ErrNoRunningSupervisor if no supervisor process is serving on the path.
+// this func only for supervisor process
+func TakeoverListeners(path string) (*Takeover, error) {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		if isNoListener(err) {
+			return nil, ErrNoRunningSupervisor
+		}
+		return nil, fmt.Errorf("graceful: failed to connect to the takeover socket %s: %v", path, err)
+	}
+	conn := c.(*net.UnixConn)
+	conn.SetReadDeadline(time.Now().Add(takeoverTimeout))
+	entries, err := receiveTakeoverEntries(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	lns, namedLns, pcs, err := ownedSockets(entries)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Takeover{
+		Listeners:      lns,
+		NamedListeners: namedLns,
+		PacketConns:    pcs,
+		conn:           conn,
+		released:       make(chan struct{}),
+	}, nil
+}
+
+// Close aborts the takeover, the running supervisor process keeps running.
+// the listeners are not closed.
+func (t *Takeover) Close() error {
+	return t.conn.Close()
+}
+
+// drain tells the running supervisor process to stop its worker and exit,
+// and waits until it releases the takeover socket.
+func (t *Takeover) drain() {
+	t.once.Do(func() {
+		defer close(t.released)
+		defer t.conn.Close()
+		t.conn.SetDeadline(time.Now().Add(takeoverTimeout))
+		if _, err := t.conn.Write([]byte{takeoverDrain}); err != nil {
+			log.Printf("graceful: failed to drain the running supervisor: %v", err)
+			return
+		}
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(t.conn, b); err != nil || b[0] != takeoverReleased {
+			log.Printf("graceful: the running supervisor did not release the takeover socket: %v", err)
+		}
+	})
+}
+
+// takeoverWaitReadyFunc returns WaitReadyFunc that drains the running supervisor process
+// after the first worker is ready.
+// this func only for supervisor process
+func takeoverWaitReadyFunc(t *Takeover, waitReadyFunc func(context.Context, []net.Conn) error) func(context.Context, []net.Conn) error {
+	return func(ctx context.Context, conns []net.Conn) error {
+		if waitReadyFunc != nil {
+			if err := waitReadyFunc(ctx, conns); err != nil {
+				return err
+			}
+		}
+		t.drain()
+		return nil
+	}
+}
+
+// takeoverRequest is the request from the takeover socket to the Serve loop
+type takeoverRequest struct {
+	// drain stops the worker and Serve returns if true, otherwise the files of the listeners are replied
+	drain   bool
+	replyCh chan takeoverReply
+}
+
+type takeoverReply struct {
+	files   []*os.File
+	entries []inheritedEntry
+	err     error
+}
+
+// takeoverServer serves the listeners to the new supervisor process on the takeover socket
+type takeoverServer struct {
+	path      string
+	requestCh chan takeoverRequest
+
+	mu     sync.Mutex
+	ln     *net.UnixListener
+	closed bool
+}
+
+// startTakeoverServer listens on the takeover socket and serves.
+// if taking over, it listens after the running supervisor process releases the socket.
+// this func only for supervisor process
+func startTakeoverServer(path string, t *Takeover, requestCh chan takeoverRequest) (*takeoverServer, error) {
+	s := &takeoverServer{path: path, requestCh: requestCh}
+	if t == nil {
+		return s, s.listen()
+	}
+	go func() {
+		<-t.released
+		if err := s.listen(); err != nil {
+			log.Println(err)
+		}
+	}()
+	return s, nil
+}
+
+// listen listens on the takeover socket.
+// the socket file left by a stopped supervisor process is removed.
+func (s *takeoverServer) listen() error {
+	if c, err := net.Dial("unix", s.path); err == nil {
+		c.Close()
+		return fmt.Errorf("graceful: the takeover socket %s is already in use", s.path)
+	} else if isNoListener(err) {
+		if fi, err := os.Lstat(s.path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(s.path)
+		}
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: s.path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("graceful: failed to listen on the takeover socket: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		ln.Close()
+		return nil
+	}
+	s.ln = ln
+	go s.serve(ln)
+	return nil
+}
+
+func (s *takeoverServer) serve(ln *net.UnixListener) {
+	for {
+		conn, err := ln.AcceptUnix()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// close closes the takeover socket and removes the socket file
+func (s *takeoverServer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+}
+
+func (s *takeoverServer) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	reply := s.request(false)
+	if reply.err != nil {
+		log.Printf("graceful: failed to take over the listeners: %v", reply.err)
+		return
+	}
+	err := sendTakeoverEntries(conn, reply.entries, reply.files)
+	closeListenerFiles(reply.files)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// the new supervisor process closes the conn without the drain if it fails to start
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil || b[0] != takeoverDrain {
+		return
+	}
+	s.close()
+	if _, err := conn.Write([]byte{takeoverReleased}); err != nil {
+		log.Printf("graceful: failed to reply to the new supervisor: %v", err)
+	}
+	s.request(true)
+}
+
+func (s *takeoverServer) request(drain bool) takeoverReply {
+	req := takeoverRequest{drain: drain, replyCh: make(chan takeoverReply, 1)}
+	s.requestCh <- req
+	return <-req.replyCh
+}
+
+// keepSocketFiles makes the unix domain socket listeners not remove the socket files on close
+func keepSocketFiles(o *option) {
+	lns := append([]net.Listener{}, o.listeners...)
+	for _, ln := range o.namedListeners {
+		lns = append(lns, ln)
+	}
+	for _, ln := range lns {
+		if ln, ok := ln.(*net.UnixListener); ok {
+			ln.SetUnlinkOnClose(false)
+		}
+	}
+}
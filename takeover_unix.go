@@ -0,0 +1,108 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package graceful
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// sendTakeoverEntries sends the length of the entries, the entries and the fds
+func sendTakeoverEntries(conn *net.UnixConn, entries []inheritedEntry, files []*os.File) error {
+	ss := make([]string, 0, len(entries))
+	fds := make([]int, 0, len(files))
+	for i, e := range entries {
+		ss = append(ss, e.String())
+		fds = append(fds, int(files[i].Fd()))
+	}
+	s := strings.Join(ss, envSep)
+	b := make([]byte, 4+len(s))
+	binary.BigEndian.PutUint32(b, uint32(len(s)))
+	copy(b[4:], s)
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	if _, _, err := conn.WriteMsgUnix(b, oob, nil); err != nil {
+		return fmt.Errorf("graceful: failed to send the listeners to the new supervisor: %v", err)
+	}
+	return nil
+}
+
+// receiveTakeoverEntries receives the entries with the fds sent by sendTakeoverEntries
+func receiveTakeoverEntries(conn *net.UnixConn) ([]inheritedEntry, error) {
+	b := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(4*maxHandoffFiles))
+	n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, fmt.Errorf("graceful: failed to receive the listeners: %v", err)
+	}
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, b[n:]); err != nil {
+		closeFiles(files)
+		return nil, fmt.Errorf("graceful: failed to receive the listeners: %v", err)
+	}
+	l := binary.BigEndian.Uint32(b)
+	if l > maxTakeoverEntries {
+		closeFiles(files)
+		return nil, fmt.Errorf("graceful: too long takeover entries %d", l)
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		closeFiles(files)
+		return nil, fmt.Errorf("graceful: failed to receive the listeners: %v", err)
+	}
+	defer closeFiles(files)
+	entries := make([]inheritedEntry, 0, len(files))
+	if l > 0 {
+		for _, s := range strings.Split(string(buf), envSep) {
+			e, err := parseInheritedEntry(s)
+			if err != nil {
+				return nil, fmt.Errorf("graceful: invalid takeover entries %q", buf)
+			}
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) != len(files) {
+		return nil, fmt.Errorf("graceful: received %d fds for %d takeover entries", len(files), len(entries))
+	}
+	for i, f := range files {
+		// the entry owns the duplicated fd, since the file closes its fd
+		syscall.ForkLock.RLock()
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err == nil {
+			syscall.CloseOnExec(fd)
+		}
+		syscall.ForkLock.RUnlock()
+		if err != nil {
+			for _, e := range entries[:i] {
+				syscall.Close(int(e.fd))
+			}
+			return nil, fmt.Errorf("graceful: failed to dup the received fd: %v", err)
+		}
+		entries[i].fd = uintptr(fd)
+	}
+	return entries, nil
+}
+
+// isNoListener reports whether the error is caused by no listener on the unix socket
+func isNoListener(err error) bool {
+	oe, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	se, ok := oe.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+	return se.Err == syscall.ECONNREFUSED || se.Err == syscall.ENOENT
+}
@@ -0,0 +1,22 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package graceful
+
+import (
+	"net"
+	"os"
+)
+
+func sendTakeoverEntries(conn *net.UnixConn, entries []inheritedEntry, files []*os.File) error {
+	return errPassFilesNotSupported
+}
+
+func receiveTakeoverEntries(conn *net.UnixConn) ([]inheritedEntry, error) {
+	return nil, errPassFilesNotSupported
+}
+
+// isNoListener reports false, the takeover is not supported on this platform
+func isNoListener(err error) bool {
+	return false
+}
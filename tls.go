@@ -0,0 +1,181 @@
+package graceful
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// environment variables to pass the certificate files to the worker process
+const (
+	envTLSCertFile = "GRACEFUL_TLS_CERT_FILE"
+	envTLSKeyFile  = "GRACEFUL_TLS_KEY_FILE"
+)
+
+// certReloadInterval is the interval to check the modification of the certificate files
+const certReloadInterval = 10 * time.Second
+
+// InheritOrListenTLS returns inherited tcp listener wrapped by tls.
+// if the addr is not included inherited addrs, create a new listener.
+// the certificate is loaded from certFile and keyFile, and reloaded without restart
+// when the files are modified or SIGHUP is received.
+// if certFile and keyFile are empty, the files passed by the supervisor process (WithTLSFiles) are used.
+// config may be nil. the certificates of the config are ignored.
+func InheritOrListenTLS(addr string, config *tls.Config, certFile, keyFile string) (net.Listener, error) {
+	if certFile == "" && keyFile == "" {
+		certFile, keyFile = os.Getenv(envTLSCertFile), os.Getenv(envTLSKeyFile)
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("graceful: certificate file and key file are required")
+	}
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := InheritOrListenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.Certificates = nil
+	config.GetCertificate = r.GetCertificate
+	r.Watch(certReloadInterval, syscall.SIGHUP)
+	return &tlsListener{Listener: tls.NewListener(ln, config), reloader: r}, nil
+}
+
+type tlsListener struct {
+	net.Listener
+	reloader *CertReloader
+}
+
+func (ln *tlsListener) Close() error {
+	ln.reloader.Stop()
+	return ln.Listener.Close()
+}
+
+// CertReloader loads the certificate from files and reloads it on demand
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	mu       sync.RWMutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCertReloader creates a new CertReloader and loads the certificate
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, stop: make(chan struct{})}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate. it can be used as tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Reload loads the certificate from the files.
+// the current certificate is kept if the files are invalid
+func (r *CertReloader) Reload() error {
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("graceful: failed to load the certificate: %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTimes = modTimes
+	return nil
+}
+
+// Watch reloads the certificate in background
+// when the files are modified, checking at every interval, or one of the sigs is received
+func (r *CertReloader) Watch(interval time.Duration, sigs ...os.Signal) {
+	sigCh := make(chan os.Signal, 1)
+	if len(sigs) > 0 {
+		signal.Notify(sigCh, sigs...)
+	}
+	go func() {
+		defer signal.Stop(sigCh)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-sigCh:
+				if err := r.Reload(); err != nil {
+					log.Println(err)
+				}
+			case <-tick.C:
+				if !r.modified() {
+					continue
+				}
+				if err := r.Reload(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops watching
+func (r *CertReloader) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (r *CertReloader) modified() bool {
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return modTimes != r.modTimes
+}
+
+func (r *CertReloader) fileModTimes() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return modTimes, fmt.Errorf("graceful: failed to stat %s: %v", f, err)
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+// tlsFilesEnv returns env vars to pass the certificate files to the worker process.
+// this func only for supervisor process
+func tlsFilesEnv(certFile, keyFile string) []string {
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("%s=%s", envTLSCertFile, certFile),
+		fmt.Sprintf("%s=%s", envTLSKeyFile, keyFile),
+	}
+}
@@ -0,0 +1,187 @@
+package graceful
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes the self-signed certificate of the serial to the files,
+// and sets the modification time of the files
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), modTime)
+}
+
+func writeTestFile(t *testing.T, name string, b []byte, modTime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshakeSerial returns the serial number of the certificate presented by the tls server of the addr
+func handshakeSerial(t *testing.T, addr string) int64 {
+	t.Helper()
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	c, err := tls.DialWithDialer(d, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+// serveTLS completes the handshake of the connections accepted on the listener
+func serveTLS(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			c.(*tls.Conn).Handshake()
+		}()
+	}
+}
+
+func tempCertFiles(t *testing.T) (string, string, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+func TestInheritOrListenTLS_Reload(t *testing.T) {
+	dir, certFile, keyFile := tempCertFiles(t)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	writeTestCert(t, certFile, keyFile, 1, now.Add(-time.Minute))
+
+	ln, err := InheritOrListenTLS("127.0.0.1:0", nil, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveTLS(ln)
+	addr := ln.Addr().String()
+	if got := handshakeSerial(t, addr); got != 1 {
+		t.Fatalf("serial got %d, want 1", got)
+	}
+
+	// the certificate is reloaded by SIGHUP without restart
+	writeTestCert(t, certFile, keyFile, 2, now)
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); handshakeSerial(t, addr) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("the certificate is not reloaded by SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the invalid files keep the current certificate
+	writeTestFile(t, certFile, []byte("invalid"), now.Add(time.Minute))
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := handshakeSerial(t, addr); got != 2 {
+		t.Errorf("serial got %d, want the current certificate 2", got)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, certFile, keyFile := tempCertFiles(t)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	writeTestCert(t, certFile, keyFile, 1, now.Add(-time.Minute))
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: r.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveTLS(ln)
+	addr := ln.Addr().String()
+
+	// Reload loads the modified files
+	writeTestCert(t, certFile, keyFile, 2, now)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := handshakeSerial(t, addr); got != 2 {
+		t.Errorf("serial got %d, want 2 after Reload", got)
+	}
+
+	// Reload of the invalid files fails, and the current certificate is kept
+	writeTestFile(t, keyFile, []byte("invalid"), now.Add(time.Minute))
+	if err := r.Reload(); err == nil {
+		t.Error("Reload of the invalid key file succeeds")
+	}
+	if got := handshakeSerial(t, addr); got != 2 {
+		t.Errorf("serial got %d, want the current certificate 2", got)
+	}
+
+	// Watch reloads the files when they are modified
+	r.Watch(10 * time.Millisecond)
+	defer r.Stop()
+	writeTestCert(t, certFile, keyFile, 3, now.Add(2*time.Minute))
+	for deadline := time.Now().Add(5 * time.Second); handshakeSerial(t, addr) != 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("the modified certificate is not reloaded by Watch")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	writeTestFile(t, certFile, []byte("invalid"), now.Add(3*time.Minute))
+	time.Sleep(100 * time.Millisecond)
+	if got := handshakeSerial(t, addr); got != 3 {
+		t.Errorf("serial got %d, want the current certificate 3", got)
+	}
+}
@@ -0,0 +1,96 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// TrackedListener wraps the listener and counts the active connections accepted from it,
+// so that the non-HTTP servers can drain the connections when the gracefulStopSignal is received,
+// as http.Server.Shutdown does.
+// the connection is active until it is closed.
+type TrackedListener struct {
+	net.Listener
+
+	mu     sync.Mutex
+	active int
+	idle   chan struct{} // closed while there are no active connections
+}
+
+// NewTrackedListener creates a new TrackedListener.
+// this func only for worker process
+func NewTrackedListener(ln net.Listener) *TrackedListener {
+	idle := make(chan struct{})
+	close(idle)
+	return &TrackedListener{Listener: ln, idle: idle}
+}
+
+// Accept waits for and returns the next connection, that is counted until it is closed
+func (l *TrackedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	if l.active == 0 {
+		l.idle = make(chan struct{})
+	}
+	l.active++
+	l.mu.Unlock()
+	return &trackedConn{Conn: c, l: l}, nil
+}
+
+// StopAccepting closes the listener, so that Accept returns an error.
+// the active connections are not closed.
+func (l *TrackedListener) StopAccepting() error {
+	return l.Listener.Close()
+}
+
+// ActiveConns returns the number of the active connections
+func (l *TrackedListener) ActiveConns() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// Wait waits until all the active connections are closed.
+// returns ctx.Err() if the ctx is done before that.
+// new connections can be accepted while waiting unless StopAccepting is called.
+func (l *TrackedListener) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		active, idle := l.active, l.idle
+		l.mu.Unlock()
+		if active == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle:
+		}
+	}
+}
+
+func (l *TrackedListener) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.active == 0 {
+		close(l.idle)
+	}
+}
+
+// trackedConn releases the count of the TrackedListener on the first close
+type trackedConn struct {
+	net.Conn
+	l    *TrackedListener
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.l.release)
+	return err
+}
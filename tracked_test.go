@@ -0,0 +1,113 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptTracked dials the listener and returns the accepted conn and the client conn
+func acceptTracked(t *testing.T, l *TrackedListener) (net.Conn, net.Conn) {
+	t.Helper()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, client
+}
+
+func TestTrackedListener_ActiveConns(t *testing.T) {
+	l := NewTrackedListener(listenTCP(t))
+	defer l.Close()
+
+	c1, client1 := acceptTracked(t, l)
+	defer client1.Close()
+	c2, client2 := acceptTracked(t, l)
+	defer client2.Close()
+	if n := l.ActiveConns(); n != 2 {
+		t.Errorf("ActiveConns got %d, want 2", n)
+	}
+	c1.Close()
+	if n := l.ActiveConns(); n != 1 {
+		t.Errorf("ActiveConns got %d, want 1", n)
+	}
+	// the double close does not release the count twice
+	c1.Close()
+	if n := l.ActiveConns(); n != 1 {
+		t.Errorf("ActiveConns got %d after the double close, want 1", n)
+	}
+	c2.Close()
+	if n := l.ActiveConns(); n != 0 {
+		t.Errorf("ActiveConns got %d, want 0", n)
+	}
+}
+
+func TestTrackedListener_StopAccepting(t *testing.T) {
+	l := NewTrackedListener(listenTCP(t))
+	c, client := acceptTracked(t, l)
+	defer c.Close()
+	defer client.Close()
+
+	if err := l.StopAccepting(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept succeeds after StopAccepting")
+	}
+	// the active connection survives
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := c.Read(buf); err != nil {
+		t.Fatalf("the active connection is broken by StopAccepting: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("read %q, want ping", buf)
+	}
+	if n := l.ActiveConns(); n != 1 {
+		t.Errorf("ActiveConns got %d, want 1", n)
+	}
+}
+
+func TestTrackedListener_Wait(t *testing.T) {
+	l := NewTrackedListener(listenTCP(t))
+	defer l.Close()
+	if err := l.Wait(context.Background()); err != nil {
+		t.Errorf("Wait without the active connections returns %v", err)
+	}
+
+	c, client := acceptTracked(t, l)
+	defer client.Close()
+
+	// ctx.Err() on timeout while the connection is active
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait returns %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// nil once the count reaches zero
+	done := make(chan error, 1)
+	go func() { done <- l.Wait(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Wait returns %v while the connection is active", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait returns %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait does not return after the connection is closed")
+	}
+}
@@ -0,0 +1,133 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envUpgradePID is the env key of the pid of the worker passed to the upgraded supervisor image
+const envUpgradePID = "GRACEFUL_UPGRADE_WORKER_PID"
+
+// ErrNotUpgraded is returned when this process is not re-executed by the upgrade
+var ErrNotUpgraded = errors.New("graceful: not upgraded")
+
+// IsUpgraded reports whether this supervisor process is re-executed by the upgrade.
+// this func only for supervisor process
+func IsUpgraded() bool {
+	_, ok := os.LookupEnv(envUpgradePID)
+	return ok
+}
+
+// UpgradedListeners creates the listeners and the packet conns passed from the previous image
+// of the supervisor process on upgrade. the named listeners are returned by name.
+// the upgraded supervisor should pass them to Serve again, instead of creating new ones.
+// returns ErrNotUpgraded if this process is not re-executed by the upgrade.
+// this func only for supervisor process
+func UpgradedListeners() ([]net.Listener, map[string]net.Listener, []net.PacketConn, error) {
+	if !IsUpgraded() {
+		return nil, nil, nil, ErrNotUpgraded
+	}
+	entries, err := fdEntries()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ownedSockets(entries)
+}
+
+// ownedSockets creates the listeners and the packet conns from the entries, owned by the supervisor process
+func ownedSockets(entries []inheritedEntry) ([]net.Listener, map[string]net.Listener, []net.PacketConn, error) {
+	lns := make([]net.Listener, 0)
+	namedLns := make(map[string]net.Listener)
+	pcs := make([]net.PacketConn, 0)
+	closeAll := func() {
+		closeListeners(lns)
+		for _, ln := range namedLns {
+			ln.Close()
+		}
+		closePacketConns(pcs)
+	}
+	for _, e := range entries {
+		if isPacketNetwork(e.network) {
+			pc, err := inheritedPacketConn(e)
+			if err != nil {
+				closeAll()
+				return nil, nil, nil, err
+			}
+			pcs = append(pcs, pc)
+			continue
+		}
+		ln, err := inheritedListener(e)
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, err
+		}
+		if ln, ok := ln.(*net.UnixListener); ok {
+			// the supervisor owns the socket file
+			ln.SetUnlinkOnClose(true)
+		}
+		if e.name != "" {
+			namedLns[e.name] = ln
+		} else {
+			lns = append(lns, ln)
+		}
+	}
+	return lns, namedLns, pcs, nil
+}
+
+// upgradedWorkerPid returns the pid of the worker passed from the previous image of the supervisor process.
+// the env of the upgrade is unset so that it does not leak to the worker processes.
+func upgradedWorkerPid() (int, bool, error) {
+	v, ok := os.LookupEnv(envUpgradePID)
+	if !ok {
+		return 0, false, nil
+	}
+	for _, k := range upgradeEnvKeys {
+		os.Unsetenv(k)
+	}
+	pid, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false, fmt.Errorf("graceful: invalid %s %q", envUpgradePID, v)
+	}
+	return pid, true, nil
+}
+
+// upgradeEnvKeys are the env keys set to the upgraded supervisor image
+var upgradeEnvKeys = []string{envKey, envFDsKey, envUpgradePID}
+
+// checkUpgradable returns the error if the state of the supervisor process can not be passed to the new image.
+// only the listeners, the packet conns and the worker are passed.
+func checkUpgradable(o *option) error {
+	switch {
+	case o.proxyNetwork != "":
+		return fmt.Errorf("graceful: the supervisor can not be upgraded in the proxy mode")
+	case len(o.files) > 0:
+		return fmt.Errorf("graceful: the supervisor can not be upgraded with the files (WithFiles)")
+	case o.handoffEnabled:
+		return fmt.Errorf("graceful: the supervisor can not be upgraded with the handoff (WithHandoffEnabled)")
+	case hasEnvDialect(o.envDialects, EnvDialectTableflip):
+		return fmt.Errorf("graceful: the supervisor can not be upgraded with the env dialect %s", EnvDialectTableflip)
+	}
+	return nil
+}
+
+// filterEnv returns the env without the keys
+func filterEnv(env []string, keys []string) []string {
+	filtered := make([]string, 0, len(env))
+	for _, kv := range env {
+		skip := false
+		for _, k := range keys {
+			if strings.HasPrefix(kv, k+"=") {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
+}
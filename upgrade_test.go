@@ -0,0 +1,28 @@
+package graceful
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckUpgradable(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []OptionFunc
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "proxy", opts: []OptionFunc{WithProxy("tcp")}, wantErr: true},
+		{name: "files", opts: []OptionFunc{WithFiles("a", os.Stdin)}, wantErr: true},
+		{name: "handoff", opts: []OptionFunc{WithHandoffEnabled(true)}, wantErr: true},
+		{name: "tableflip", opts: []OptionFunc{WithEnvDialects(EnvDialectTableflip)}, wantErr: true},
+		{name: "einhorn", opts: []OptionFunc{WithEnvDialects(EnvDialectEinhorn)}},
+	}
+	for _, tt := range tests {
+		o := &option{}
+		o.applyOrDefault(tt.opts)
+		if err := checkUpgradable(o); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kei2100/go-graceful/supervisor"
+)
+
+// upgrade re-executes the executable of this process in place, passing the listeners and the pid of the worker.
+// the worker stays the child of this process, so the new image can adopt it.
+// returns only if the re-exec fails.
+func upgrade(sv *supervisor.Supervisor, o *option) error {
+	if err := checkUpgradable(o); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("graceful: failed to get the executable: %v", err)
+	}
+	files, entries, err := createExtraFiles(o)
+	if err != nil {
+		return err
+	}
+	defer closeListenerFiles(files)
+	lnsEnv, err := listenersEnv(entries, nil)
+	if err != nil {
+		return err
+	}
+
+	// no process must be started while the fds without FD_CLOEXEC are open
+	syscall.ForkLock.Lock()
+	defer syscall.ForkLock.Unlock()
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		// the duplicated fd does not have FD_CLOEXEC, so it is passed to the new image
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			closeFDs(fds)
+			return fmt.Errorf("graceful: failed to dup the listener fd: %v", err)
+		}
+		fds = append(fds, fd)
+	}
+	ss := make([]string, 0, len(fds))
+	for _, fd := range fds {
+		ss = append(ss, strconv.Itoa(fd))
+	}
+	env := append(filterEnv(os.Environ(), upgradeEnvKeys), lnsEnv...)
+	env = append(env,
+		fmt.Sprintf("%s=%s", envFDsKey, strings.Join(ss, envSep)),
+		fmt.Sprintf("%s=%d", envUpgradePID, sv.WorkerPid()),
+	)
+	err = syscall.Exec(exe, os.Args, env)
+	closeFDs(fds)
+	return fmt.Errorf("graceful: failed to re-exec %s: %v", exe, err)
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		if err := syscall.Close(fd); err != nil {
+			log.Printf("graceful: failed to close fd %d: %v", fd, err)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package graceful
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/kei2100/go-graceful/supervisor"
+)
+
+// upgrade is not supported on this platform, since the process can not be re-executed in place
+func upgrade(sv *supervisor.Supervisor, o *option) error {
+	return fmt.Errorf("graceful: the supervisor can not be upgraded on %s", runtime.GOOS)
+}
@@ -0,0 +1,9 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package worker
+
+import "syscall"
+
+// Credential is the user and the groups of the worker process
+type Credential = syscall.Credential
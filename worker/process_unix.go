@@ -0,0 +1,36 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package worker
+
+import "syscall"
+
+// sysProcAttr runs the process in its own process group, so that the signals are delivered to its children,
+// and the SIGINT from the terminal is not delivered to it but only to the supervisor
+func sysProcAttr(cred *Credential) (*syscall.SysProcAttr, error) {
+	return &syscall.SysProcAttr{Setpgid: true, Credential: cred}, nil
+}
+
+// processGroup returns the process group of the process if it is the group leader, otherwise 0
+func processGroup(pid int) int {
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		return pgid
+	}
+	return 0
+}
+
+// signalGroup sends the signal to the process group. the group that has already exited is ignored
+func signalGroup(pgid int, sig syscall.Signal) error {
+	if err := syscall.Kill(-pgid, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// signalPid sends the signal to the process. the process that has already exited is ignored
+func signalPid(pid int, sig syscall.Signal) error {
+	if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
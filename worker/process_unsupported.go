@@ -0,0 +1,33 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package worker
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// sysProcAttr does not set the process group on this platform, and the credential is not supported
+func sysProcAttr(cred *Credential) (*syscall.SysProcAttr, error) {
+	if cred != nil {
+		return nil, fmt.Errorf("worker: the credential is not supported on %s", runtime.GOOS)
+	}
+	return nil, nil
+}
+
+// processGroup returns 0, since the process does not run in its own process group on this platform
+func processGroup(pid int) int {
+	return 0
+}
+
+// signalGroup is not supported on this platform
+func signalGroup(pgid int, sig syscall.Signal) error {
+	return fmt.Errorf("worker: the process group is not supported on %s", runtime.GOOS)
+}
+
+// signalPid is not supported on this platform
+func signalPid(pid int, sig syscall.Signal) error {
+	return fmt.Errorf("worker: sending the signal is not supported on %s", runtime.GOOS)
+}
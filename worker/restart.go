@@ -0,0 +1,115 @@
+package worker
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// default values of RestartPolicy
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	defaultJitter         = 0.2
+	defaultWindow         = time.Minute
+)
+
+// RestartPolicy represents the policy of the auto restart.
+// the zero value restarts with the default backoff and never gives up.
+type RestartPolicy struct {
+	// InitialBackoff is the delay before the first restart. doubles on each successive restart.
+	// default 100ms
+	InitialBackoff time.Duration
+	// MaxBackoff is the upper limit of the delay. the delay is reset to InitialBackoff
+	// after the process has been running for longer than MaxBackoff.
+	// default 30s
+	MaxBackoff time.Duration
+	// Jitter randomizes the delay by the fraction, e.g. 0.2 makes it between 80% and 120%.
+	// default 0.2, negative disables
+	Jitter float64
+	// MaxRestarts is the maximum number of the restarts within the Window.
+	// the worker is in the crash loop when it exceeds, see CrashLoopError. 0 is unlimited
+	MaxRestarts int
+	// Window is the period to count the restarts for MaxRestarts.
+	// default 1m
+	Window time.Duration
+	// CrashLoopFunc is called when the crash loop is detected if not nil.
+	// the worker keeps restarting if it returns true, with the restarts counted from zero.
+	// otherwise the worker gives up, and Err returns the CrashLoopError.
+	CrashLoopFunc func(err *CrashLoopError) bool
+}
+
+// CrashLoopError is the error when the worker exits too many times in a short period
+type CrashLoopError struct {
+	Restarts int
+	Window   time.Duration
+	// Err is the error of the last exit of the process, nil if it exited successfully
+	Err error
+}
+
+func (e *CrashLoopError) Error() string {
+	return fmt.Sprintf("worker: crash loop detected, restarted %d times within %v. last exit: %v", e.Restarts, e.Window, e.Err)
+}
+
+// restartBackoff tracks the restarts of a worker with RestartPolicy
+type restartBackoff struct {
+	policy   RestartPolicy
+	delay    time.Duration
+	restarts []time.Time
+}
+
+func newRestartBackoff(p RestartPolicy) *restartBackoff {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.Jitter == 0 {
+		p.Jitter = defaultJitter
+	}
+	if p.Window <= 0 {
+		p.Window = defaultWindow
+	}
+	return &restartBackoff{policy: p}
+}
+
+// next returns the delay before the restart of the process that ran for the uptime,
+// the uptime is 0 if the process failed to start.
+// or CrashLoopError if the restarts exceed MaxRestarts within the Window.
+func (b *restartBackoff) next(uptime time.Duration, exitErr error) (time.Duration, *CrashLoopError) {
+	now := time.Now()
+	if b.policy.MaxRestarts > 0 {
+		recent := b.restarts[:0]
+		for _, t := range b.restarts {
+			if now.Sub(t) < b.policy.Window {
+				recent = append(recent, t)
+			}
+		}
+		b.restarts = append(recent, now)
+		if len(b.restarts) > b.policy.MaxRestarts {
+			err := &CrashLoopError{Restarts: len(b.restarts) - 1, Window: b.policy.Window, Err: exitErr}
+			if b.policy.CrashLoopFunc == nil || !b.policy.CrashLoopFunc(err) {
+				return 0, err
+			}
+			b.restarts = b.restarts[:0]
+		}
+	}
+
+	if uptime > b.policy.MaxBackoff || b.delay == 0 {
+		b.delay = b.policy.InitialBackoff
+	} else {
+		b.delay *= 2
+		if b.delay > b.policy.MaxBackoff {
+			b.delay = b.policy.MaxBackoff
+		}
+	}
+	d := b.delay
+	if b.policy.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * b.policy.Jitter * float64(d))
+	}
+	return d, nil
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff_Next(t *testing.T) {
+	b := newRestartBackoff(RestartPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond, Jitter: -1})
+	// the delay doubles up to the MaxBackoff
+	for i, want := range []time.Duration{10, 20, 40, 40} {
+		d, err := b.next(0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != want*time.Millisecond {
+			t.Errorf("#%d delay got %v, want %v", i, d, want*time.Millisecond)
+		}
+	}
+	// the delay is reset after the process has been running for longer than the MaxBackoff
+	if d, _ := b.next(time.Second, nil); d != 10*time.Millisecond {
+		t.Errorf("delay after the long uptime got %v, want 10ms", d)
+	}
+	if d, _ := b.next(0, nil); d != 20*time.Millisecond {
+		t.Errorf("delay after the reset got %v, want 20ms", d)
+	}
+}
+
+func TestRestartBackoff_Jitter(t *testing.T) {
+	b := newRestartBackoff(RestartPolicy{InitialBackoff: 100 * time.Millisecond, Jitter: 0.5})
+	for i := 0; i < 100; i++ {
+		b.delay = 0
+		d, _ := b.next(0, nil)
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("delay got %v, want between 50ms and 150ms", d)
+		}
+	}
+}
+
+func TestRestartBackoff_CrashLoop(t *testing.T) {
+	exitErr := errors.New("exit 1")
+	b := newRestartBackoff(RestartPolicy{MaxRestarts: 2, Window: time.Minute})
+	for i := 0; i < 2; i++ {
+		if _, err := b.next(0, exitErr); err != nil {
+			t.Fatalf("#%d got %v, want no crash loop", i, err)
+		}
+	}
+	_, err := b.next(0, exitErr)
+	if err == nil {
+		t.Fatal("got no crash loop")
+	}
+	if err.Restarts != 2 || err.Window != time.Minute || err.Err != exitErr {
+		t.Errorf("got %+v", err)
+	}
+}
+
+func TestRestartBackoff_WindowExpiry(t *testing.T) {
+	b := newRestartBackoff(RestartPolicy{MaxRestarts: 1, Window: 50 * time.Millisecond})
+	if _, err := b.next(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the restart out of the window is not counted
+	time.Sleep(60 * time.Millisecond)
+	if _, err := b.next(0, nil); err != nil {
+		t.Fatalf("got %v, want no crash loop after the window", err)
+	}
+	if _, err := b.next(0, nil); err == nil {
+		t.Fatal("got no crash loop within the window")
+	}
+}
+
+func TestRestartBackoff_DefaultWindow(t *testing.T) {
+	b := newRestartBackoff(RestartPolicy{MaxRestarts: 1})
+	if b.policy.Window != defaultWindow {
+		t.Errorf("window got %v, want %v", b.policy.Window, defaultWindow)
+	}
+	b.next(0, nil)
+	if _, err := b.next(0, nil); err == nil {
+		t.Fatal("got no crash loop without the window")
+	}
+}
+
+func TestRestartBackoff_CrashLoopFunc(t *testing.T) {
+	var called []*CrashLoopError
+	keep := true
+	b := newRestartBackoff(RestartPolicy{MaxRestarts: 1, Window: time.Minute, CrashLoopFunc: func(err *CrashLoopError) bool {
+		called = append(called, err)
+		return keep
+	}})
+	b.next(0, nil)
+	// the restarts are counted from zero if the CrashLoopFunc returns true
+	if _, err := b.next(0, nil); err != nil {
+		t.Fatalf("got %v, want to keep restarting", err)
+	}
+	if len(called) != 1 {
+		t.Fatalf("CrashLoopFunc is called %d times, want 1", len(called))
+	}
+	if _, err := b.next(0, nil); err != nil {
+		t.Fatalf("got %v, want the restarts counted from zero", err)
+	}
+	keep = false
+	if _, err := b.next(0, nil); err == nil {
+		t.Fatal("got no crash loop, want to give up")
+	}
+	if len(called) != 2 {
+		t.Errorf("CrashLoopFunc is called %d times, want 2", len(called))
+	}
+}
@@ -0,0 +1,204 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package worker
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// subreaperInterval is the interval to track the descendants of the workers
+const subreaperInterval = time.Second
+
+// procKey identifies a process. the start time distinguishes the reused pids
+type procKey struct {
+	pid   int
+	start uint64
+}
+
+// procStat is the state of a process read from the process table
+type procStat struct {
+	ppid  int
+	pgrp  int
+	state byte
+	start uint64
+}
+
+// subreaper tracks the workers and their descendants, and reaps the orphaned processes
+// adopted by the supervisor process.
+type subreaper struct {
+	// mu is held for writing while reaping, and for reading while a worker starts its process,
+	// so that the started process is not reaped before the worker knows its pid.
+	mu      sync.RWMutex
+	workers map[*Worker]bool
+	once    sync.Once
+}
+
+var reaper = &subreaper{workers: make(map[*Worker]bool)}
+
+// EnableSubreaper makes this process the subreaper of its descendants,
+// so that the orphaned descendants of the workers are reparented to this process instead of init.
+// the orphans are reaped, and attributed to the worker that spawned them,
+// then they are terminated when the worker is stopped.
+// the orphans are attributed by the process group, since each worker is a process group leader,
+// so the orphan that left the process group before it is tracked, e.g. by setsid, is only reaped.
+//
+// note that all the children of this process other than the workers are reaped,
+// so this process must not start the other processes that it waits for by itself, e.g. by os/exec.
+// linux only
+func EnableSubreaper() error {
+	if err := setChildSubreaper(); err != nil {
+		return err
+	}
+	reaper.once.Do(func() { go reaper.run() })
+	return nil
+}
+
+func (r *subreaper) register(w *Worker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.workers[w] = true
+}
+
+func (r *subreaper) unregister(w *Worker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.workers, w)
+}
+
+func (r *subreaper) run() {
+	sigCh := make(chan os.Signal, 1)
+	notifyChild(sigCh)
+	tick := time.NewTicker(subreaperInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-sigCh:
+		case <-tick.C:
+		}
+		r.reap()
+	}
+}
+
+// reap tracks the descendants of the workers, and reaps the orphaned zombies
+func (r *subreaper) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	procs := listProcs()
+	if procs == nil {
+		return
+	}
+	children := make(map[int][]int)
+	for pid, st := range procs {
+		children[st.ppid] = append(children[st.ppid], pid)
+	}
+	workers := make(map[int]*Worker)
+	for w := range r.workers {
+		w.pruneDescendants(procs)
+		if pid, ok := w.processPid(); ok {
+			workers[pid] = w
+			w.trackDescendants(procs, children, pid)
+		}
+	}
+	for _, pid := range children[os.Getpid()] {
+		if _, ok := workers[pid]; ok {
+			continue
+		}
+		st := procs[pid]
+		key := procKey{pid: pid, start: st.start}
+		if w := r.owner(key, st); w != nil {
+			w.track(key)
+			w.trackDescendants(procs, children, pid)
+		}
+		if st.state != 'Z' {
+			continue
+		}
+		var ws syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); err != nil && err != syscall.ECHILD {
+			log.Printf("worker: failed to reap orphan process %d: %v", pid, err)
+		}
+	}
+}
+
+// owner returns the worker that spawned the orphan.
+// if the orphan is not tracked yet, e.g. it daemonized quickly,
+// the worker whose process group the orphan belongs to is assumed.
+// returns nil if the orphan left the process group before it is tracked.
+func (r *subreaper) owner(key procKey, st procStat) *Worker {
+	for w := range r.workers {
+		if w.isTracked(key) {
+			return w
+		}
+	}
+	for w := range r.workers {
+		if pgid := w.processGroup(); pgid != 0 && pgid == st.pgrp {
+			return w
+		}
+	}
+	return nil
+}
+
+// processGroup returns the process group of the worker, 0 if the process is not the group leader
+func (w *Worker) processGroup() int {
+	w.cmdMu.RLock()
+	defer w.cmdMu.RUnlock()
+	return w.pgid
+}
+
+func (w *Worker) track(key procKey) {
+	w.descendantsMu.Lock()
+	defer w.descendantsMu.Unlock()
+	if w.descendants == nil {
+		w.descendants = make(map[procKey]bool)
+	}
+	w.descendants[key] = true
+}
+
+func (w *Worker) isTracked(key procKey) bool {
+	w.descendantsMu.Lock()
+	defer w.descendantsMu.Unlock()
+	return w.descendants[key]
+}
+
+// pruneDescendants forgets the tracked descendants that have exited
+func (w *Worker) pruneDescendants(procs map[int]procStat) {
+	w.descendantsMu.Lock()
+	defer w.descendantsMu.Unlock()
+	for key := range w.descendants {
+		if st, ok := procs[key.pid]; !ok || st.start != key.start {
+			delete(w.descendants, key)
+		}
+	}
+}
+
+func (w *Worker) trackDescendants(procs map[int]procStat, children map[int][]int, pid int) {
+	queue := []int{pid}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, c := range children[p] {
+			w.track(procKey{pid: c, start: procs[c].start})
+			queue = append(queue, c)
+		}
+	}
+}
+
+// signalDescendants sends the signal to the tracked descendants that are still running,
+// including the orphans that left the process group of the worker
+func (w *Worker) signalDescendants(sig syscall.Signal) {
+	w.descendantsMu.Lock()
+	defer w.descendantsMu.Unlock()
+	for key := range w.descendants {
+		if start, ok := procStart(key.pid); !ok || start != key.start {
+			delete(w.descendants, key)
+			continue
+		}
+		if err := signalPid(key.pid, sig); err != nil {
+			log.Printf("worker: failed to send %s to descendant process %d: %v", sig, key.pid, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER of prctl, which is not defined by the syscall package
+const prSetChildSubreaper = 36
+
+func setChildSubreaper() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return fmt.Errorf("worker: failed to set the child subreaper: %v", errno)
+	}
+	return nil
+}
+
+func notifyChild(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGCHLD)
+}
+
+// listProcs reads the process table from /proc/<pid>/stat
+func listProcs() map[int]procStat {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil
+	}
+	procs := make(map[int]procStat, len(stats))
+	for _, path := range stats {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+		if err != nil {
+			continue
+		}
+		if st, ok := readProcStat(path); ok {
+			procs[pid] = st
+		}
+	}
+	return procs
+}
+
+// procStart returns the start time of the process
+func procStart(pid int) (uint64, bool) {
+	st, ok := readProcStat(fmt.Sprintf("/proc/%d/stat", pid))
+	if !ok || st.state == 'Z' {
+		return 0, false
+	}
+	return st.start, true
+}
+
+func readProcStat(path string) (procStat, bool) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return procStat{}, false
+	}
+	// pid (comm) state ppid pgrp session tty_nr tpgid flags minflt cminflt majflt cmajflt
+	// utime stime cutime cstime priority nice num_threads itrealvalue starttime ...
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 20 {
+		return procStat{}, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return procStat{}, false
+	}
+	pgrp, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return procStat{}, false
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return procStat{}, false
+	}
+	return procStat{ppid: ppid, pgrp: pgrp, state: fields[0][0], start: start}, true
+}
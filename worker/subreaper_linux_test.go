@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSubreaper_DoubleFork(t *testing.T) {
+	if err := EnableSubreaper(); err != nil {
+		t.Skip(err)
+	}
+	dir, err := ioutil.TempDir("", "graceful-worker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the sleeper leaves the process group of the worker, and is orphaned after the intermediate shell exits
+	script := `dir=$1
+(setsid sleep 60 & echo $! > "$dir/pid"; sleep 0.5) &
+exec sleep 60
+`
+	w := &Worker{Command: "/bin/sh", Args: []string{"-c", script, "sh", dir}}
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Kill()
+	pid, err := strconv.Atoi(waitFile(t, filepath.Join(dir, "pid")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// track the sleeper while the intermediate shell is running
+	reaper.reap()
+
+	// the orphaned sleeper is reparented to this process
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		st, ok := readProcStat(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+		if ok && st.ppid == os.Getpid() {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("process %d is not reparented", pid)
+		}
+	}
+
+	ctx, can := context.WithTimeout(context.Background(), 5*time.Second)
+	defer can()
+	if err := w.Stop(ctx, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	// the sleeper is terminated with the worker, and reaped by this process
+	for start := time.Now(); syscall.Kill(pid, 0) != syscall.ESRCH; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("process %d is not reaped", pid)
+		}
+	}
+}
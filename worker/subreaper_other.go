@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package worker
+
+import (
+	"errors"
+	"os"
+)
+
+var errSubreaperNotSupported = errors.New("worker: the subreaper is not supported on this platform")
+
+func setChildSubreaper() error {
+	return errSubreaperNotSupported
+}
+
+func notifyChild(_ chan<- os.Signal) {}
+
+func listProcs() map[int]procStat {
+	return nil
+}
+
+func procStart(_ int) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,31 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package worker
+
+import "testing"
+
+func TestSubreaper_Owner(t *testing.T) {
+	old, cur := &Worker{pgid: 100}, &Worker{pgid: 200}
+	r := &subreaper{workers: map[*Worker]bool{old: true, cur: true}}
+	tracked := procKey{pid: 300, start: 1}
+	cur.track(tracked)
+
+	tests := []struct {
+		key  procKey
+		st   procStat
+		want *Worker
+	}{
+		// the orphan of the old worker is not attributed to the current worker that started later
+		{key: procKey{pid: 301, start: 2}, st: procStat{pgrp: 100, start: 2}, want: old},
+		{key: procKey{pid: 302, start: 3}, st: procStat{pgrp: 200, start: 3}, want: cur},
+		{key: tracked, st: procStat{pgrp: 300, start: 1}, want: cur},
+		// the orphan that left the process group before it is tracked
+		{key: procKey{pid: 303, start: 4}, st: procStat{pgrp: 303, start: 4}, want: nil},
+	}
+	for _, tt := range tests {
+		if got := r.owner(tt.key, tt.st); got != tt.want {
+			t.Errorf("owner of %+v got %p, want %p", tt.key, got, tt.want)
+		}
+	}
+}
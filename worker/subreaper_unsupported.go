@@ -0,0 +1,38 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package worker
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+)
+
+var errSubreaperNotSupported = errors.New("worker: the subreaper is not supported on this platform")
+
+// procKey identifies a process. the descendants are not tracked on this platform
+type procKey struct {
+	pid   int
+	start uint64
+}
+
+// subreaper does nothing on this platform
+type subreaper struct {
+	mu sync.RWMutex
+}
+
+var reaper = &subreaper{}
+
+// EnableSubreaper makes this process the subreaper of its descendants.
+// linux only, returns the error on this platform
+func EnableSubreaper() error {
+	return errSubreaperNotSupported
+}
+
+func (r *subreaper) register(w *Worker) {}
+
+func (r *subreaper) unregister(w *Worker) {}
+
+// signalDescendants does nothing, since the descendants are not tracked on this platform
+func (w *Worker) signalDescendants(sig syscall.Signal) {}
@@ -0,0 +1,24 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package worker
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// pPID is P_PID of waitid, which is not defined by the syscall package
+const pPID = 1
+
+// waitExited blocks until the process exits without reaping it, so that its pid and process group
+// are not reused until it is waited. returns false if the process can not be waited
+func waitExited(pid int) bool {
+	var siginfo [128]byte
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(pid), uintptr(unsafe.Pointer(&siginfo[0])), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		if errno != syscall.EINTR {
+			return errno == 0
+		}
+	}
+}
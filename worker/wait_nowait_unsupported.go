@@ -0,0 +1,10 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package worker
+
+// waitExited does not wait for the process on this platform, since waitid is not available.
+// the process group is killed after the process is reaped instead
+func waitExited(pid int) bool {
+	return false
+}
@@ -8,10 +8,13 @@ import (
 	"os"
 	"os/exec"
 	"sync"
+	"syscall"
 	"time"
 )
 
-// Worker represents a worker process
+// Worker represents a worker process.
+// the stdin of the supervisor is passed to the worker process unless it is a character device such as the terminal,
+// since the worker in its own process group is stopped by SIGTTIN if it reads the terminal.
 type Worker struct {
 	Command       string
 	Args          []string
@@ -20,12 +23,30 @@ type Worker struct {
 	WaitReadyFunc func(ctx context.Context, extraFileConns []net.Conn) error
 	StartTimeout  time.Duration
 
+	// Credential is the user and the groups of the worker process. nil runs as the same user as the supervisor.
+	// the ExtraFiles are still available to the worker, since they are passed as the fds.
+	Credential *Credential
+
+	// RestartPolicy is the backoff and the crash loop detection of the auto restart
+	RestartPolicy RestartPolicy
+
 	autoRestart   bool
+	cancelRestart chan struct{} // closed when the auto restart is disabled
 	autoRestartMu sync.RWMutex
 
-	cmd   *exec.Cmd
-	cmdMu sync.RWMutex
-	stop  chan struct{}
+	cmd       *exec.Cmd
+	process   *os.Process // the process of the cmd, or the adopted process
+	pgid      int         // the process group of the process, 0 if it is not the group leader
+	startedAt time.Time
+	exited    bool
+	stopping  bool // Stop or Kill is called
+	err       error
+	cmdMu     sync.RWMutex
+	stop      chan struct{}
+
+	// the descendants tracked by the subreaper, see EnableSubreaper
+	descendants   map[procKey]bool
+	descendantsMu sync.Mutex
 }
 
 // Start this Worker
@@ -33,34 +54,183 @@ func (w *Worker) Start(ctx context.Context) error {
 	if w.WaitReadyFunc == nil {
 		w.WaitReadyFunc = func(_ context.Context, _ []net.Conn) error { return nil }
 	}
+	reaper.register(w)
 	if err := w.startProcess(ctx); err != nil {
+		w.abort()
+		reaper.unregister(w)
 		return err
 	}
+	w.monitor()
+	return nil
+}
+
+// workerStdin returns the stdin of the supervisor to pass to the worker process, nil if it is a character device
+func workerStdin() *os.File {
+	fi, err := os.Stdin.Stat()
+	if err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return nil
+	}
+	return os.Stdin
+}
+
+// abort kills the process that is started but not ready, and waits for it
+func (w *Worker) abort() {
+	w.cmdMu.RLock()
+	started := w.process != nil
+	w.cmdMu.RUnlock()
+	if !started {
+		return
+	}
+	if err := w.Kill(); err != nil {
+		log.Println(err)
+	}
+	w.waitProcess()
+}
+
+// Adopt makes this Worker manage the running process instead of starting a new one.
+// the process must be a child of this process, e.g. started by the previous image
+// of this process before the re-exec.
+func (w *Worker) Adopt(pid int) error {
+	if w.WaitReadyFunc == nil {
+		w.WaitReadyFunc = func(_ context.Context, _ []net.Conn) error { return nil }
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("worker: failed to find process %d: %v", pid, err)
+	}
+	if err := p.Signal(syscall.Signal(0)); err != nil {
+		return fmt.Errorf("worker: process %d is not running: %v", pid, err)
+	}
+	reaper.register(w)
+	w.cmdMu.Lock() // cmd LOCK
+	w.cmd, w.process = nil, p
+	// started in its own process group by the previous image
+	w.pgid = processGroup(pid)
+	w.startedAt, w.exited = time.Now(), false
+	w.cmdMu.Unlock() // cmd UNLOCK
+	w.monitor()
+	return nil
+}
+
+// Pid returns the pid of the worker process
+func (w *Worker) Pid() int {
+	w.cmdMu.RLock()
+	defer w.cmdMu.RUnlock()
+	return w.process.Pid
+}
+
+// processPid returns the pid of the process of the worker, false if it is not started
+func (w *Worker) processPid() (int, bool) {
+	w.cmdMu.RLock()
+	defer w.cmdMu.RUnlock()
+	if w.process == nil {
+		return 0, false
+	}
+	return w.process.Pid, true
+}
+
+// Err returns the error why the worker is done by itself, ExitError or CrashLoopError.
+// nil if the worker is not done, exited successfully or stopped by Stop or Kill.
+func (w *Worker) Err() error {
+	w.cmdMu.RLock()
+	defer w.cmdMu.RUnlock()
+	return w.err
+}
+
+// monitor waits for the process, and restarts it with the backoff if the auto restart is enabled
+func (w *Worker) monitor() {
 	w.stop = make(chan struct{})
 	go func() {
 		defer close(w.stop)
+		defer reaper.unregister(w)
+		backoff := newRestartBackoff(w.RestartPolicy)
+		var startErr error // the error of the auto restart that failed to start the process
 		for {
-			if err := w.waitProcess(); err != nil {
-				log.Println(err)
+			err := startErr
+			if startErr == nil {
+				// the helpers of the process must not keep the ports after the process exits.
+				// the group is killed before the process is reaped if possible, so that the pgid is not reused
+				pid, _ := w.processPid()
+				exited := waitExited(pid)
+				if exited {
+					w.killGroup()
+				}
+				err = w.waitProcess()
+				if !exited {
+					w.killGroup()
+				}
+				w.signalDescendants(syscall.SIGKILL)
+			}
+			autoRestart := w.isAutoRestart()
+			w.cmdMu.Lock() // cmd LOCK
+			w.exited = true
+			// the process that failed to start counts as the exit without the uptime
+			var uptime time.Duration
+			if startErr == nil {
+				uptime = time.Since(w.startedAt)
 			}
-			if !w.isAutoRestart() {
+			if err != nil && !autoRestart && !w.stopping {
+				// the caller of the worker handles the error
+				w.err = err
+				w.cmdMu.Unlock() // cmd UNLOCK
 				return
 			}
-			log.Println("worker: auto restarting")
-			if err := w.startProcess(context.Background()); err != nil {
+			w.cmdMu.Unlock() // cmd UNLOCK
+			if err != nil {
 				log.Println(err)
 			}
+			if !autoRestart {
+				return
+			}
+			delay, cerr := backoff.next(uptime, err)
+			if cerr != nil {
+				w.cmdMu.Lock() // cmd LOCK
+				w.err = cerr
+				w.cmdMu.Unlock() // cmd UNLOCK
+				return
+			}
+			log.Printf("worker: auto restarting in %v", delay.Round(time.Millisecond))
+			t := time.NewTimer(delay)
+			select {
+			case <-w.restartCanceled():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			startErr = w.restartProcess()
 		}
 	}()
-	return nil
+}
+
+// restartProcess starts the process by the auto restart.
+// returns the error only if the process is not started, the process that is not ready keeps running.
+func (w *Worker) restartProcess() error {
+	w.cmdMu.RLock()
+	prev := w.cmd
+	w.cmdMu.RUnlock()
+	err := w.startProcess(context.Background())
+	if err == nil {
+		return nil
+	}
+	w.cmdMu.RLock()
+	started := w.cmd != prev
+	w.cmdMu.RUnlock()
+	if started {
+		log.Println(err)
+		return nil
+	}
+	return err
 }
 
 // Stop this Worker
 func (w *Worker) Stop(ctx context.Context, sig os.Signal) error {
-	w.SetAutoRestart(false)
+	w.setStopping()
 	if err := w.signalProcess(sig); err != nil {
 		return err
 	}
+	if s, ok := sig.(syscall.Signal); ok {
+		w.signalDescendants(s)
+	}
 	select {
 	case <-ctx.Done():
 		return fmt.Errorf("worker: an error occurred while waiting for stop: %v", ctx.Err())
@@ -69,11 +239,47 @@ func (w *Worker) Stop(ctx context.Context, sig os.Signal) error {
 	}
 }
 
-// Kill causes the Worker process to exit immediately.
+// Kill causes the Worker process and its process group to exit immediately.
 // Kill does not wait until the Process has actually exited.
 func (w *Worker) Kill() error {
+	w.setStopping()
+	w.signalDescendants(syscall.SIGKILL)
+	w.cmdMu.RLock()
+	pgid := w.pgid
+	w.cmdMu.RUnlock()
+	if pgid == 0 {
+		return w.signalProcess(os.Kill)
+	}
+	if err := signalGroup(pgid, syscall.SIGKILL); err != nil {
+		return fmt.Errorf("worker: failed to kill process group %d: %v", pgid, err)
+	}
+	return nil
+}
+
+// killGroup kills the processes remaining in the process group of the exited process.
+// the pgid may be reused by the others after the process is reaped, so it should be called before that
+func (w *Worker) killGroup() {
+	w.cmdMu.RLock()
+	pgid := w.pgid
+	w.cmdMu.RUnlock()
+	if pgid == 0 {
+		return
+	}
+	if err := signalGroup(pgid, syscall.SIGKILL); err != nil {
+		log.Printf("worker: failed to kill process group %d: %v", pgid, err)
+	}
+}
+
+func (w *Worker) setStopping() {
+	w.cmdMu.Lock()
+	w.stopping = true
+	w.cmdMu.Unlock()
 	w.SetAutoRestart(false)
-	return w.signalProcess(os.Kill)
+}
+
+// Signal sends the signal to the Worker process and its process group
+func (w *Worker) Signal(sig os.Signal) error {
+	return w.signalProcess(sig)
 }
 
 // Done returns a channel that's closed when this worker is done
@@ -86,6 +292,23 @@ func (w *Worker) SetAutoRestart(enabled bool) {
 	w.autoRestartMu.Lock()
 	defer w.autoRestartMu.Unlock()
 	w.autoRestart = enabled
+	if !enabled && w.cancelRestart != nil {
+		close(w.cancelRestart)
+		w.cancelRestart = nil
+	}
+}
+
+// restartCanceled returns a channel that's closed when the auto restart is disabled
+func (w *Worker) restartCanceled() <-chan struct{} {
+	w.autoRestartMu.Lock()
+	defer w.autoRestartMu.Unlock()
+	if w.cancelRestart == nil {
+		w.cancelRestart = make(chan struct{})
+		if !w.autoRestart {
+			close(w.cancelRestart)
+		}
+	}
+	return w.cancelRestart
 }
 
 func (w *Worker) isAutoRestart() bool {
@@ -101,55 +324,147 @@ func (w *Worker) startProcess(ctx context.Context) error {
 	}
 	defer can()
 
+	attr, err := sysProcAttr(w.Credential)
+	if err != nil {
+		return err
+	}
+	// the subreaper must not reap the process until the pid is set
+	reaper.mu.RLock()
 	w.cmdMu.Lock() // cmd LOCK
 	cmd := exec.Command(w.Command, w.Args...)
-	cmd.Stdin = os.Stdin
+	if stdin := workerStdin(); stdin != nil {
+		cmd.Stdin = stdin
+	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.ExtraFiles = w.ExtraFiles
 	cmd.Env = w.Env
+	cmd.SysProcAttr = attr
 	if err := cmd.Start(); err != nil {
 		w.cmdMu.Unlock() // cmd UNLOCK
+		reaper.mu.RUnlock()
+		if w.Credential != nil {
+			return fmt.Errorf("worker: failed to restart command as uid %d gid %d: %v", w.Credential.Uid, w.Credential.Gid, err)
+		}
 		return fmt.Errorf("worker: failed to restart command: %v", err)
 	}
-	w.cmd = cmd
+	w.cmd, w.process, w.pgid = cmd, cmd.Process, processGroup(cmd.Process.Pid)
+	w.startedAt, w.exited = time.Now(), false
 	w.cmdMu.Unlock() // cmd UNLOCK
+	reaper.mu.RUnlock()
 
 	conns, err := createFileConns(w.cmd.ExtraFiles)
 	if err != nil {
 		return err
 	}
 	defer closeFileConns(conns)
+	ctx = context.WithValue(ctx, pidContextKey{}, cmd.Process.Pid)
 	if err := w.WaitReadyFunc(ctx, conns); err != nil {
 		return fmt.Errorf("worker: WaitReadyFunc returns %v", err)
 	}
 	return nil
 }
 
+type pidContextKey struct{}
+
+// PidFromContext returns the pid of the worker process.
+// it is available in the context passed to WaitReadyFunc
+func PidFromContext(ctx context.Context) (int, bool) {
+	pid, ok := ctx.Value(pidContextKey{}).(int)
+	return pid, ok
+}
+
 func (w *Worker) waitProcess() error {
 	w.cmdMu.RLock() // cmd LOCK
-	cmd := w.cmd
+	cmd, process := w.cmd, w.process
 	w.cmdMu.RUnlock() // cmd UNLOCK
 
-	if err := cmd.Wait(); err != nil {
+	if cmd == nil {
+		// the adopted process
+		state, err := process.Wait()
+		if err != nil {
+			return fmt.Errorf("worker: failed to wait process %d: %v", process.Pid, err)
+		}
+		if !state.Success() {
+			return newExitError(state)
+		}
+		return nil
+	}
+	err := cmd.Wait()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return newExitError(ee.ProcessState)
+	}
+	if err != nil {
 		return fmt.Errorf("worker: command abnormally finished: %v", err)
 	}
 	return nil
 }
 
+// ExitError is the error when the worker process exits unsuccessfully
+type ExitError struct {
+	Pid int
+	// Code is the exit code, -1 if the process is terminated by the signal
+	Code int
+	// Signal is the signal that terminated the process, 0 if it exited.
+	// always 0 on windows, where the process is not terminated by the signal
+	Signal syscall.Signal
+	// Rusage is the resource usage of the process, nil if not available.
+	// the fields depend on the platform, e.g. only the process times are available on windows
+	Rusage *syscall.Rusage
+
+	state *os.ProcessState
+}
+
+func newExitError(state *os.ProcessState) *ExitError {
+	e := &ExitError{Pid: state.Pid(), Code: -1, state: state}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok {
+		if ws.Signaled() {
+			e.Signal = ws.Signal()
+		} else {
+			e.Code = ws.ExitStatus()
+		}
+	}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		e.Rusage = ru
+	}
+	return e
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("worker: command abnormally finished: %v", e.state)
+}
+
 func (w *Worker) signalProcess(sig os.Signal) error {
 	w.cmdMu.RLock()
 	defer w.cmdMu.RUnlock()
 
-	if err := w.cmd.Process.Signal(sig); err != nil {
+	if w.exited {
+		// waiting for the auto restart, or done
+		return nil
+	}
+	if w.process == nil {
+		return fmt.Errorf("worker: process is not started")
+	}
+	if s, ok := sig.(syscall.Signal); ok && w.pgid != 0 {
+		if err := signalGroup(w.pgid, s); err != nil {
+			return fmt.Errorf("worker: failed to send %s to process group %d: %v", sig, w.pgid, err)
+		}
+		return nil
+	}
+	if err := w.process.Signal(sig); err != nil {
 		return fmt.Errorf("worker: failed to send %s: %v", sig, err)
 	}
 	return nil
 }
 
+// createFileConns creates connections from the socket files.
+// the files other than sockets are skipped.
 func createFileConns(files []*os.File) ([]net.Conn, error) {
 	conns := make([]net.Conn, 0)
 	for _, f := range files {
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeSocket == 0 {
+			continue
+		}
 		c, err := net.FileConn(f)
 		if err != nil {
 			closeFileConns(conns)
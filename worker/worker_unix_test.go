@@ -0,0 +1,277 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeScript writes the shell script to the temp dir, and returns its path
+func writeScript(t *testing.T, dir, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, "worker.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWorker_AutoRestartStartFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful-worker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the auto restart fails to start the process, since the command removes itself
+	path := writeScript(t, dir, "rm -f \"$0\"\nsleep 0.1\nexit 1\n")
+
+	w := &Worker{
+		Command:       path,
+		RestartPolicy: RestartPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: time.Second, Jitter: -1, MaxRestarts: 3, Window: time.Minute},
+	}
+	w.SetAutoRestart(true)
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	select {
+	case <-w.Done():
+	case <-time.After(10 * time.Second):
+		w.Kill()
+		t.Fatal("the worker is not in the crash loop")
+	}
+	cerr, ok := w.Err().(*CrashLoopError)
+	if !ok {
+		t.Fatalf("err got %T %v, want CrashLoopError", w.Err(), w.Err())
+	}
+	if cerr.Err == nil || !strings.Contains(cerr.Err.Error(), "failed to restart command") {
+		t.Errorf("last exit got %v, want the start failure", cerr.Err)
+	}
+	// the backoff is not reset by the start failures, 10ms + 20ms + 40ms
+	if d := time.Since(start); d < 70*time.Millisecond {
+		t.Errorf("crash loop detected in %v, want the backoff", d)
+	}
+}
+
+func TestWorker_ExitError(t *testing.T) {
+	tests := []struct {
+		script string
+		code   int
+		sig    syscall.Signal
+	}{
+		{script: "exit 3\n", code: 3},
+		{script: "kill -KILL $$\n", code: -1, sig: syscall.SIGKILL},
+	}
+	for _, tt := range tests {
+		w := &Worker{Command: "/bin/sh", Args: []string{"-c", tt.script}}
+		if err := w.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-w.Done():
+		case <-time.After(5 * time.Second):
+			w.Kill()
+			t.Fatalf("%q does not exit", tt.script)
+		}
+		e, ok := w.Err().(*ExitError)
+		if !ok {
+			t.Fatalf("%q err got %T %v, want ExitError", tt.script, w.Err(), w.Err())
+		}
+		if e.Pid != w.Pid() || e.Code != tt.code || e.Signal != tt.sig {
+			t.Errorf("%q got pid %d code %d signal %v, want pid %d code %d signal %v", tt.script, e.Pid, e.Code, e.Signal, w.Pid(), tt.code, tt.sig)
+		}
+		if e.Rusage == nil {
+			t.Errorf("%q got no rusage", tt.script)
+		}
+	}
+}
+
+// waitFile waits until the file is written, and returns its content
+func waitFile(t *testing.T, path string) string {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if b, err := ioutil.ReadFile(path); err == nil && len(b) > 0 {
+			return strings.TrimSpace(string(b))
+		}
+	}
+	t.Fatalf("%s is not written", path)
+	return ""
+}
+
+// processGone reports whether the process has exited, it may be a zombie not reaped by init yet
+func processGone(pid int) bool {
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return true
+	}
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestWorker_StopProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful-worker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the shell wraps the child that handles SIGTERM, and the child that ignores it.
+	// the shell exits after the former child on SIGTERM
+	script := `dir=$1
+(trap 'echo term > "$dir/term"; exit 0' TERM; echo ready > "$dir/ready"; sleep 60 & wait) &
+child=$!
+(trap '' TERM; exec sleep 60) &
+trap 'wait $child; exit 0' TERM
+echo $! > "$dir/pid"
+wait
+`
+	w := &Worker{Command: "/bin/sh", Args: []string{"-c", script, "sh", dir}}
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFile(t, filepath.Join(dir, "ready"))
+	pid, err := strconv.Atoi(waitFile(t, filepath.Join(dir, "pid")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, can := context.WithTimeout(context.Background(), 5*time.Second)
+	defer can()
+	if err := w.Stop(ctx, syscall.SIGTERM); err != nil {
+		w.Kill()
+		t.Fatal(err)
+	}
+	// the child of the shell receives the stop signal
+	if term := waitFile(t, filepath.Join(dir, "term")); term != "term" {
+		t.Errorf("term got %q", term)
+	}
+	// the child ignoring the stop signal is killed after the shell exits
+	for start := time.Now(); !processGone(pid); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("process %d is not killed", pid)
+		}
+	}
+}
+
+func TestWorker_SignalProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful-worker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the shell and its child handle SIGUSR1, and the shell exits after the child
+	script := `dir=$1
+(trap 'echo child > "$dir/child"; exit 0' USR1; echo ready > "$dir/ready"; sleep 60 & wait) &
+trap 'echo leader > "$dir/leader"' USR1
+echo ready > "$dir/leader-ready"
+wait
+wait
+`
+	w := &Worker{Command: "/bin/sh", Args: []string{"-c", script, "sh", dir}}
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Kill()
+	waitFile(t, filepath.Join(dir, "ready"))
+	waitFile(t, filepath.Join(dir, "leader-ready"))
+	if err := w.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"leader", "child"} {
+		if got := waitFile(t, filepath.Join(dir, name)); got != name {
+			t.Errorf("%s got %q", name, got)
+		}
+	}
+	select {
+	case <-w.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker does not exit")
+	}
+	if err := w.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWorker_StartCredentialFailure(t *testing.T) {
+	// the uid -1 is invalid even for root, so the switch to the credential fails
+	w := &Worker{
+		Command:    "/bin/sh",
+		Args:       []string{"-c", "exit 0"},
+		Credential: &Credential{Uid: 1<<32 - 1, Gid: uint32(os.Getgid()), NoSetGroups: true},
+	}
+	err := w.Start(context.Background())
+	if err == nil {
+		w.Kill()
+		t.Fatal("Start succeeds with the invalid credential")
+	}
+	if !strings.Contains(err.Error(), "as uid 4294967295") {
+		t.Errorf("err got %v, want the failure of the credential", err)
+	}
+}
+
+func TestWorker_Stdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful-worker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "stdin")
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+
+	readStdin := func() string {
+		t.Helper()
+		w := &Worker{Command: "/bin/sh", Args: []string{"-c", "head -c 4 > " + out}}
+		if err := w.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-w.Done():
+		case <-time.After(5 * time.Second):
+			w.Kill()
+			t.Fatal("the worker does not exit")
+		}
+		b, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// the pipe is passed to the worker
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	pw.WriteString("ping")
+	pw.Close()
+	os.Stdin = r
+	if got := readStdin(); got != "ping" {
+		t.Errorf("stdin of the pipe got %q, want ping", got)
+	}
+
+	// the character device, as the terminal, is not passed to the worker
+	zero, err := os.Open("/dev/zero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zero.Close()
+	os.Stdin = zero
+	if got := readStdin(); got != "" {
+		t.Errorf("stdin of the character device got %q, want empty", got)
+	}
+}